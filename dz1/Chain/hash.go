@@ -0,0 +1,110 @@
+package Chain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Signature"
+)
+
+// UnixNano is t.UnixNano, with the zero time mapped to 0.
+func UnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func writeUint64(h hash.Hash, v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	h.Write(buf[:])
+}
+
+func writeString(h hash.Hash, s string) {
+	writeUint64(h, uint64(len(s)))
+	h.Write([]byte(s))
+}
+
+// MeasurementHash is the Merkle leaf of a single signed measurement.
+func MeasurementHash(username, param string, value float64, measured time.Time, seq uint64, sig []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{MerkleLeaf})
+	h.Write(Signature.Payload(username, param, value, measured, seq))
+	h.Write(sig)
+	return h.Sum(nil)
+}
+
+// BlockHash hashes a block's header. digest and sig are the snapshot digest
+// and its signature on checkpoint blocks and nil otherwise.
+func BlockHash(root []byte, id int, at time.Time, difficulty int, nonce uint64, digest, sig, prev []byte) []byte {
+	h := sha256.New()
+	h.Write(root)
+	writeUint64(h, uint64(id))
+	writeUint64(h, uint64(UnixNano(at)))
+	writeUint64(h, uint64(difficulty))
+	writeUint64(h, nonce)
+	h.Write(digest)
+	h.Write(sig)
+	h.Write(prev)
+	return h.Sum(nil)
+}
+
+// SnapshotDigest is what the server signs on a checkpoint block: the block's
+// place in the chain and the state it carries, in a canonical order.
+func SnapshotDigest(id int, at time.Time, prev []byte, state map[string]map[string]float64, seqs map[string]uint64) []byte {
+	h := sha256.New()
+	writeUint64(h, uint64(id))
+	writeUint64(h, uint64(UnixNano(at)))
+	h.Write(prev)
+
+	usernames := make([]string, 0, len(state))
+	for username := range state {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	writeUint64(h, uint64(len(usernames)))
+	for _, username := range usernames {
+		writeString(h, username)
+		params := make([]string, 0, len(state[username]))
+		for param := range state[username] {
+			params = append(params, param)
+		}
+		sort.Strings(params)
+		writeUint64(h, uint64(len(params)))
+		for _, param := range params {
+			writeString(h, param)
+			writeUint64(h, math.Float64bits(state[username][param]))
+		}
+	}
+
+	usernames = usernames[:0]
+	for username := range seqs {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	writeUint64(h, uint64(len(usernames)))
+	for _, username := range usernames {
+		writeString(h, username)
+		writeUint64(h, seqs[username])
+	}
+	return h.Sum(nil)
+}
+
+// MeetsDifficulty reports whether hash starts with at least d zero bits.
+func MeetsDifficulty(hash []byte, d int) bool {
+	zeros := 0
+	for _, b := range hash {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+	return zeros >= d
+}
@@ -0,0 +1,92 @@
+package Chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Leaves and inner nodes are hashed with different prefixes so a leaf can
+// never be passed off as an inner node.
+const (
+	MerkleLeaf = 0x00
+	MerkleNode = 0x01
+)
+
+func merkleParent(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{MerkleNode})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleLevels returns every level of the tree built over leaves, starting
+// with the leaves themselves. A node without a sibling moves up unchanged.
+func merkleLevels(leaves [][]byte) [][][]byte {
+	sol := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleParent(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		sol = append(sol, next)
+		level = next
+	}
+	return sol
+}
+
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+	levels := merkleLevels(leaves)
+	return levels[len(levels)-1][0]
+}
+
+type ProofStep struct {
+	Hash string `json:"hash"`
+	// Left is set when Hash is the left sibling.
+	Left bool `json:"left"`
+}
+
+// MerkleProof lists the siblings needed to climb from leaves[i] to the root.
+func MerkleProof(leaves [][]byte, i int) []ProofStep {
+	sol := []ProofStep{}
+	for _, level := range merkleLevels(leaves) {
+		if len(level) == 1 {
+			break
+		}
+		if sibling := i ^ 1; sibling < len(level) {
+			sol = append(sol, ProofStep{
+				Hash: hex.EncodeToString(level[sibling]),
+				Left: sibling < i,
+			})
+		}
+		i /= 2
+	}
+	return sol
+}
+
+// VerifyProof reports whether proof, as MerkleProof makes it, climbs from
+// leaf to root. Each step hashes the node so far with the sibling on the
+// side Left says; a node that had no sibling on a level has no step there.
+func VerifyProof(leaf []byte, proof []ProofStep, root []byte) bool {
+	node := leaf
+	for _, step := range proof {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		if step.Left {
+			node = merkleParent(sibling, node)
+		} else {
+			node = merkleParent(node, sibling)
+		}
+	}
+	return len(root) > 0 && bytes.Equal(node, root)
+}
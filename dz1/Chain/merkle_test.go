@@ -0,0 +1,73 @@
+package Chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func testLeaves(n int) [][]byte {
+	sol := make([][]byte, n)
+	for i := range sol {
+		h := sha256.Sum256([]byte(fmt.Sprint("leaf ", i)))
+		sol[i] = h[:]
+	}
+	return sol
+}
+
+func TestVerifyProof(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 15, 16, 17, 31, 33} {
+		leaves := testLeaves(n)
+		root := MerkleRoot(leaves)
+		for i := range leaves {
+			proof := MerkleProof(leaves, i)
+			if !VerifyProof(leaves[i], proof, root) {
+				t.Errorf("%d leaves: proof of leaf %d does not verify", n, i)
+				continue
+			}
+			other := leaves[(i+1)%n]
+			if n > 1 && VerifyProof(other, proof, root) {
+				t.Errorf("%d leaves: proof of leaf %d verifies leaf %d", n, i, (i+1)%n)
+			}
+			if VerifyProof(leaves[i], proof, MerkleRoot(testLeaves(n+1))) {
+				t.Errorf("%d leaves: proof of leaf %d verifies against another root", n, i)
+			}
+			for j := range proof {
+				bad := append([]ProofStep{}, proof...)
+				bad[j].Left = !bad[j].Left
+				if VerifyProof(leaves[i], bad, root) {
+					t.Errorf("%d leaves: proof of leaf %d verifies with step %d on the wrong side", n, i, j)
+				}
+				bad[j] = ProofStep{Hash: hex.EncodeToString(leaves[i]), Left: proof[j].Left}
+				if VerifyProof(leaves[i], bad, root) {
+					t.Errorf("%d leaves: proof of leaf %d verifies with step %d replaced", n, i, j)
+				}
+			}
+			if len(proof) > 0 && VerifyProof(leaves[i], proof[:len(proof)-1], root) {
+				t.Errorf("%d leaves: proof of leaf %d verifies without its last step", n, i)
+			}
+		}
+	}
+}
+
+func TestVerifyProofRejects(t *testing.T) {
+	leaves := testLeaves(4)
+	root := MerkleRoot(leaves)
+	tests := []struct {
+		name  string
+		leaf  []byte
+		proof []ProofStep
+		root  []byte
+	}{
+		{"no root", leaves[0], MerkleProof(leaves, 0), nil},
+		{"bad hex", leaves[0], []ProofStep{{Hash: "zz"}, MerkleProof(leaves, 0)[1]}, root},
+		{"leaf for root", root, nil, leaves[0]},
+		{"no proof", leaves[0], nil, root},
+	}
+	for _, test := range tests {
+		if VerifyProof(test.leaf, test.proof, test.root) {
+			t.Errorf("%s: VerifyProof = true", test.name)
+		}
+	}
+}
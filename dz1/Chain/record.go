@@ -0,0 +1,150 @@
+package Chain
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"time"
+)
+
+type MeasurementRecord struct {
+	Username string     `json:"username"`
+	Param    string     `json:"param"`
+	Value    float64    `json:"value"`
+	Measured *time.Time `json:"measured,omitempty"`
+	Seq      uint64     `json:"seq"`
+	Sig      string     `json:"signature"`
+}
+
+type SnapshotRecord struct {
+	State map[string]map[string]float64 `json:"state"`
+	Seqs  map[string]uint64             `json:"seqs"`
+	Sig   string                        `json:"signature"`
+}
+
+// Record is the on-disk and wire form of a block; the block log and chain
+// exports hold one per line. Hashes and signatures are hex.
+type Record struct {
+	Id           int                 `json:"id"`
+	Time         time.Time           `json:"time"`
+	Measurements []MeasurementRecord `json:"measurements"`
+	Root         string              `json:"root"`
+	Difficulty   int                 `json:"difficulty"`
+	Nonce        uint64              `json:"nonce"`
+	Snapshot     *SnapshotRecord     `json:"snapshot,omitempty"`
+	Prev         string              `json:"prev"`
+	Hash         string              `json:"hash"`
+}
+
+// Leaves returns the Merkle leaves of rec's measurements, in order.
+func (rec *Record) Leaves() ([][]byte, error) {
+	sol := make([][]byte, len(rec.Measurements))
+	for i, m := range rec.Measurements {
+		sig, err := hex.DecodeString(m.Sig)
+		if err != nil {
+			return nil, err
+		}
+		var measured time.Time
+		if m.Measured != nil {
+			measured = *m.Measured
+		}
+		sol[i] = MeasurementHash(m.Username, m.Param, m.Value, measured, m.Seq, sig)
+	}
+	return sol, nil
+}
+
+// ComputeRoot recomputes the Merkle root of rec's measurements.
+func (rec *Record) ComputeRoot() ([]byte, error) {
+	leaves, err := rec.Leaves()
+	if err != nil {
+		return nil, err
+	}
+	return MerkleRoot(leaves), nil
+}
+
+// ComputeHash recomputes the block hash from everything rec holds except its
+// stored root and hash.
+func (rec *Record) ComputeHash() ([]byte, error) {
+	root, err := rec.ComputeRoot()
+	if err != nil {
+		return nil, err
+	}
+	prev, err := hex.DecodeString(rec.Prev)
+	if err != nil {
+		return nil, err
+	}
+	var digest, sig []byte
+	if rec.Snapshot != nil {
+		if sig, err = hex.DecodeString(rec.Snapshot.Sig); err != nil {
+			return nil, err
+		}
+		digest = SnapshotDigest(rec.Id, rec.Time, prev, rec.Snapshot.State, rec.Snapshot.Seqs)
+	}
+	return BlockHash(root, rec.Id, rec.Time, rec.Difficulty, rec.Nonce, digest, sig, prev), nil
+}
+
+// SnapshotValid reports whether key signed the snapshot of checkpoint
+// block rec.
+func (rec *Record) SnapshotValid(key ed25519.PublicKey) bool {
+	prev, err := hex.DecodeString(rec.Prev)
+	if err != nil {
+		return false
+	}
+	sig, err := hex.DecodeString(rec.Snapshot.Sig)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, SnapshotDigest(rec.Id, rec.Time, prev, rec.Snapshot.State, rec.Snapshot.Seqs), sig)
+}
+
+type Report struct {
+	Height     int    `json:"height"`
+	Base       int    `json:"base"` // genesis, or the checkpoint the chain was pruned to
+	Valid      bool   `json:"valid"`
+	FirstBadId int    `json:"firstBadId,omitempty"`
+	Expected   string `json:"expected,omitempty"` // hash, or root when that is what differs
+	Actual     string `json:"actual,omitempty"`
+}
+
+// Verify walks recs from the newest back to the oldest recomputing every
+// Merkle root and hash and reports the lowest block whose stored root, hash
+// or id does not match, whose time is before the previous block's, whose
+// hash lacks the work it claims or claims less than minDifficulty or, when
+// key is given, whose checkpoint signature is wrong.
+// The oldest record is the base the rest is checked against; only a chain
+// starting at block 1 is linked to genesis.
+func Verify(recs []Record, key ed25519.PublicKey, minDifficulty int) Report {
+	if len(recs) == 0 {
+		return Report{Valid: true}
+	}
+	sol := Report{Height: recs[len(recs)-1].Id, Base: recs[0].Id, Valid: true}
+	for i := len(recs) - 1; i >= 0; i-- {
+		curr := &recs[i]
+		if curr.Id == 0 {
+			continue
+		}
+		expected, err := curr.ComputeHash()
+		actual, _ := hex.DecodeString(curr.Hash)
+		root, _ := curr.ComputeRoot()
+		rootOk := hex.EncodeToString(root) == curr.Root
+		ok := err == nil && rootOk && bytes.Equal(expected, actual) && curr.Difficulty >= minDifficulty && MeetsDifficulty(expected, curr.Difficulty)
+		if curr.Snapshot != nil && key != nil {
+			ok = ok && curr.SnapshotValid(key)
+		}
+		if i > 0 {
+			ok = ok && curr.Id == recs[i-1].Id+1 && curr.Prev == recs[i-1].Hash && !curr.Time.Before(recs[i-1].Time)
+		} else if curr.Id == 1 {
+			ok = ok && curr.Prev == ""
+		}
+		if !ok {
+			sol.Valid = false
+			sol.FirstBadId = curr.Id
+			sol.Expected = hex.EncodeToString(expected)
+			sol.Actual = curr.Hash
+			if !rootOk {
+				sol.Expected, sol.Actual = hex.EncodeToString(root), curr.Root
+			}
+		}
+	}
+	return sol
+}
@@ -0,0 +1,27 @@
+package Geo
+
+import "math"
+
+// EarthRadius is the mean radius of the Earth in kilometres.
+const EarthRadius = 6371.0088
+
+// Point is a location in degrees.
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// Distance is the great-circle distance between a and b in kilometres, by
+// the haversine formula.
+func Distance(a, b Point) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dlat := lat2 - lat1
+	dlon := radians(b.Lon - a.Lon)
+	h := math.Pow(math.Sin(dlat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dlon/2), 2)
+	// rounding can push h just past 1 for antipodal points
+	return 2 * EarthRadius * math.Asin(math.Sqrt(math.Min(1, h)))
+}
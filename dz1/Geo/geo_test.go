@@ -0,0 +1,41 @@
+package Geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	london := Point{Lat: 51.5074, Lon: -0.1278}
+	paris := Point{Lat: 48.8566, Lon: 2.3522}
+	zagreb := Point{Lat: 45.8150, Lon: 15.9819}
+	split := Point{Lat: 43.5081, Lon: 16.4402}
+	newYork := Point{Lat: 40.7128, Lon: -74.0060}
+	losAngeles := Point{Lat: 34.0522, Lon: -118.2437}
+	sydney := Point{Lat: -33.8688, Lon: 151.2093}
+	auckland := Point{Lat: -36.8485, Lon: 174.7633}
+	tests := []struct {
+		name string
+		a, b Point
+		want float64 // km
+	}{
+		{"London Paris", london, paris, 343.557},
+		{"Zagreb Split", zagreb, split, 259.063},
+		{"New York Los Angeles", newYork, losAngeles, 3935.752},
+		{"Sydney Auckland", sydney, auckland, 2155.901},
+		{"same point", zagreb, zagreb, 0},
+		{"pole at any longitude", Point{Lat: 90, Lon: 0}, Point{Lat: 90, Lon: 123}, 0},
+		{"antipodal", Point{Lat: 10, Lon: 20}, Point{Lat: -10, Lon: -160}, math.Pi * EarthRadius},
+		{"pole to pole", Point{Lat: 90, Lon: 0}, Point{Lat: -90, Lon: 0}, math.Pi * EarthRadius},
+		{"across the dateline", Point{Lat: 0, Lon: 179.5}, Point{Lat: 0, Lon: -179.5}, 111.195},
+		{"dateline either way", Point{Lat: 0, Lon: -180}, Point{Lat: 0, Lon: 180}, 0},
+	}
+	for _, test := range tests {
+		for _, pair := range [][2]Point{{test.a, test.b}, {test.b, test.a}} {
+			sol := Distance(pair[0], pair[1])
+			if math.IsNaN(sol) || math.Abs(sol-test.want) > 0.01 {
+				t.Errorf("%s: Distance(%v, %v) = %.3f, want %.3f", test.name, pair[0], pair[1], sol, test.want)
+			}
+		}
+	}
+}
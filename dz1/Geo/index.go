@@ -0,0 +1,188 @@
+package Geo
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+)
+
+// Index finds the points nearest to a location. It is a k-d tree over
+// points on the unit sphere, where the straight-line (chord) distance
+// orders points the same as the great-circle one. Removed points are only
+// marked; the tree is rebuilt balanced once inserts or removals outnumber
+// the points it was last built with.
+type Index struct {
+	root    *node
+	byKey   map[string]*node
+	built   int // points in the tree when it was last rebuilt
+	changes int // inserts and removals since
+}
+
+type node struct {
+	key         string
+	p           Point
+	v           [3]float64
+	axis        int
+	left, right *node
+	removed     bool
+}
+
+// Hit is a point found in an Index.
+type Hit struct {
+	Key      string
+	Point    Point
+	Distance float64 // km
+}
+
+func NewIndex() *Index {
+	return &Index{byKey: make(map[string]*node)}
+}
+
+func unit(p Point) [3]float64 {
+	lat, lon := radians(p.Lat), radians(p.Lon)
+	return [3]float64{math.Cos(lat) * math.Cos(lon), math.Cos(lat) * math.Sin(lon), math.Sin(lat)}
+}
+
+func chord2(a, b [3]float64) float64 {
+	dx, dy, dz := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dx*dx + dy*dy + dz*dz
+}
+
+// Len is how many points the index holds.
+func (ix *Index) Len() int {
+	return len(ix.byKey)
+}
+
+// Insert adds key at p, moving it if it is already there.
+func (ix *Index) Insert(key string, p Point) {
+	ix.Remove(key)
+	n := &node{key: key, p: p, v: unit(p)}
+	ix.byKey[key] = n
+	if ix.root == nil {
+		ix.root = n
+	} else {
+		parent := ix.root
+		for {
+			next := &parent.right
+			if n.v[parent.axis] < parent.v[parent.axis] {
+				next = &parent.left
+			}
+			if *next == nil {
+				n.axis = (parent.axis + 1) % 3
+				*next = n
+				break
+			}
+			parent = *next
+		}
+	}
+	ix.changed()
+}
+
+// Remove drops key, reporting whether it was there.
+func (ix *Index) Remove(key string) bool {
+	n, ok := ix.byKey[key]
+	if !ok {
+		return false
+	}
+	n.removed = true
+	delete(ix.byKey, key)
+	ix.changed()
+	return true
+}
+
+func (ix *Index) changed() {
+	ix.changes++
+	if ix.changes > ix.built {
+		nodes := make([]*node, 0, len(ix.byKey))
+		for _, n := range ix.byKey {
+			nodes = append(nodes, n)
+		}
+		ix.root = build(nodes, 0)
+		ix.built, ix.changes = len(nodes), 0
+	}
+}
+
+// build makes a balanced tree of nodes, splitting on the median.
+func build(nodes []*node, axis int) *node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].v[axis] < nodes[j].v[axis] })
+	mid := len(nodes) / 2
+	// equal coordinates must all end up on the right
+	for mid > 0 && nodes[mid-1].v[axis] == nodes[mid].v[axis] {
+		mid--
+	}
+	n := nodes[mid]
+	n.axis, n.left, n.right = axis, build(nodes[:mid], (axis+1)%3), build(nodes[mid+1:], (axis+1)%3)
+	return n
+}
+
+type found struct {
+	n  *node
+	d2 float64
+}
+
+// farthest is a max-heap, so the worst of the best k is on top.
+type farthest []found
+
+func (h farthest) Len() int { return len(h) }
+func (h farthest) Less(i, j int) bool {
+	if h[i].d2 != h[j].d2 {
+		return h[i].d2 > h[j].d2
+	}
+	return h[i].n.key > h[j].n.key
+}
+func (h farthest) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *farthest) Push(x interface{}) { *h = append(*h, x.(found)) }
+func (h *farthest) Pop() interface{} {
+	sol := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return sol
+}
+
+// Nearest returns the points within km of p for which keep is true,
+// nearest first, at most k of them when k > 0. keep may be nil.
+func (ix *Index) Nearest(p Point, k int, km float64, keep func(key string) bool) []Hit {
+	v := unit(p)
+	limit := math.Inf(+1) // squared chord of km
+	if a := km / EarthRadius; a < math.Pi {
+		limit = math.Pow(2*math.Sin(a/2), 2)
+	}
+	h := &farthest{}
+	var visit func(n *node)
+	visit = func(n *node) {
+		if n == nil {
+			return
+		}
+		if d2 := chord2(v, n.v); !n.removed && d2 <= limit && (keep == nil || keep(n.key)) {
+			heap.Push(h, found{n, d2})
+			if k > 0 && h.Len() > k {
+				heap.Pop(h)
+			}
+		}
+		near, far := n.left, n.right
+		diff := v[n.axis] - n.v[n.axis]
+		if diff >= 0 {
+			near, far = far, near
+		}
+		visit(near)
+		// the far side is only worth it if the splitting plane is closer
+		// than the worst point kept so far
+		bound := limit
+		if k > 0 && h.Len() == k {
+			bound = math.Min(bound, (*h)[0].d2)
+		}
+		if diff*diff <= bound {
+			visit(far)
+		}
+	}
+	visit(ix.root)
+
+	sol := make([]Hit, h.Len())
+	for i := len(sol) - 1; i >= 0; i-- {
+		n := heap.Pop(h).(found).n
+		sol[i] = Hit{Key: n.key, Point: n.p, Distance: Distance(p, n.p)}
+	}
+	return sol
+}
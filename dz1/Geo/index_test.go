@@ -0,0 +1,164 @@
+package Geo
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func randomPoint(r *rand.Rand) Point {
+	// uniform over the sphere, not bunched at the poles
+	return Point{Lat: math.Asin(2*r.Float64()-1) * 180 / math.Pi, Lon: 360*r.Float64() - 180}
+}
+
+// scan is what Nearest answers, found by measuring the distance to every
+// point.
+func scan(points map[string]Point, p Point, k int, km float64, keep func(key string) bool) []Hit {
+	sol := []Hit{}
+	for key, q := range points {
+		if d := Distance(p, q); d <= km && (keep == nil || keep(key)) {
+			sol = append(sol, Hit{Key: key, Point: q, Distance: d})
+		}
+	}
+	sort.Slice(sol, func(i, j int) bool { return sol[i].Distance < sol[j].Distance })
+	if k > 0 && len(sol) > k {
+		sol = sol[:k]
+	}
+	return sol
+}
+
+// sameHits tells whether got and want find the same distances in the same
+// order; points equally far may come in either order.
+func sameHits(got, want []Hit) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.Abs(got[i].Distance-want[i].Distance) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestNearestMatchesScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	ix := NewIndex()
+	points := map[string]Point{}
+	check := func(step string) {
+		for q := 0; q < 20; q++ {
+			p := randomPoint(r)
+			k := r.Intn(8)
+			km := math.Inf(+1)
+			if r.Intn(2) == 0 {
+				km = 5000 * r.Float64()
+			}
+			odd := func(key string) bool { return len(key)%2 == 1 }
+			for _, keep := range []func(string) bool{nil, odd} {
+				sol := ix.Nearest(p, k, km, keep)
+				want := scan(points, p, k, km, keep)
+				if !sameHits(sol, want) {
+					t.Fatalf("%s: Nearest(%v, %d, %.0f) = %v, want %v", step, p, k, km, sol, want)
+				}
+				for _, hit := range sol {
+					if points[hit.Key] != hit.Point {
+						t.Fatalf("%s: %s found at %v, it is at %v", step, hit.Key, hit.Point, points[hit.Key])
+					}
+				}
+			}
+		}
+		if ix.Len() != len(points) {
+			t.Fatalf("%s: Len() = %d, want %d", step, ix.Len(), len(points))
+		}
+	}
+
+	keys := []string{}
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprint("p", i)
+		keys = append(keys, key)
+		points[key] = randomPoint(r)
+		ix.Insert(key, points[key])
+	}
+	check("after inserts")
+	for _, key := range keys[:200] {
+		if !ix.Remove(key) {
+			t.Fatalf("Remove(%s) = false", key)
+		}
+		delete(points, key)
+	}
+	if ix.Remove(keys[0]) {
+		t.Fatalf("Remove(%s) twice = true", keys[0])
+	}
+	check("after removals")
+	for _, key := range keys[200:350] {
+		points[key] = randomPoint(r)
+		ix.Insert(key, points[key])
+	}
+	check("after moves")
+	for i := 0; i < 1000; i++ {
+		key := keys[r.Intn(len(keys))]
+		switch r.Intn(3) {
+		case 0:
+			ix.Remove(key)
+			delete(points, key)
+		default:
+			points[key] = randomPoint(r)
+			ix.Insert(key, points[key])
+		}
+	}
+	check("after a mix")
+	// points on top of each other and on the same meridian
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprint("same", i)
+		points[key] = Point{Lat: float64(i % 5), Lon: 16}
+		ix.Insert(key, points[key])
+	}
+	check("after duplicates")
+}
+
+func benchmarkPoints(n int) ([]Point, []Point) {
+	r := rand.New(rand.NewSource(int64(n)))
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = randomPoint(r)
+	}
+	queries := make([]Point, 1000)
+	for i := range queries {
+		queries[i] = randomPoint(r)
+	}
+	return points, queries
+}
+
+func BenchmarkNearest(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		points, queries := benchmarkPoints(n)
+		ix := NewIndex()
+		for i, p := range points {
+			ix.Insert(fmt.Sprint(i), p)
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ix.Nearest(queries[i%len(queries)], 10, math.Inf(+1), nil)
+			}
+		})
+	}
+}
+
+// BenchmarkScan is the same search done without an index, measuring the
+// distance to every point.
+func BenchmarkScan(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		points, queries := benchmarkPoints(n)
+		byKey := make(map[string]Point, n)
+		for i, p := range points {
+			byKey[fmt.Sprint(i)] = p
+		}
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				scan(byKey, queries[i%len(queries)], 10, math.Inf(+1), nil)
+			}
+		})
+	}
+}
@@ -2,17 +2,20 @@ package main
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/google/uuid"
+	"github.com/nmiculinic/rassus/dz1/Signature"
 	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -20,29 +23,35 @@ import (
 )
 
 type Context struct {
-	Username    string  `json:"username"`
-	Lat         float64 `json:"lat"`
-	Lon         float64 `json:"lon"`
-	IP          string  `json:"ip"`
-	Port        int     `json:"port"`
+	Username    string   `json:"username"`
+	Lat         float64  `json:"lat"`
+	Lon         float64  `json:"lon"`
+	IP          string   `json:"ip"`
+	Port        int      `json:"port"`
+	PublicKey   []byte   `json:"publicKey"`
+	Params      []string `json:"params"`
+	key         ed25519.PrivateKey
+	seq         uint64
 	data        map[string]float64
 	neighbour   *net.Conn
 	neighReader *bufio.Reader
 	lock        sync.Mutex
 }
 
-func genDesc() (*Context, error) {
+func genDesc(key ed25519.PrivateKey) (*Context, error) {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 	return &Context{
-		Username: uuid.New().String(),
-		Lon:      rand.Float64()*0.1 + 45.75,
-		Lat:      rand.Float64()*0.13 + 15.87,
-		IP:       conn.LocalAddr().(*net.UDPAddr).IP.String(),
-		data:     make(map[string]float64),
+		Username:  uuid.New().String(),
+		Lat:       rand.Float64()*0.1 + 45.75,
+		Lon:       rand.Float64()*0.13 + 15.87,
+		IP:        conn.LocalAddr().(*net.UDPAddr).IP.String(),
+		PublicKey: key.Public().(ed25519.PublicKey),
+		key:       key,
+		data:      make(map[string]float64),
 	}, nil
 }
 
@@ -54,12 +63,47 @@ type resp struct {
 }
 
 type ServerConn struct {
+	// conn_str moves to the leader on a redirect, while the heartbeat
+	// goroutine may be calling too, so it is read and written under mutex.
 	conn_str *net.TCPAddr
+	mutex    sync.Mutex
 	id       int32
 }
 
+func (server *ServerConn) addr() *net.TCPAddr {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.conn_str
+}
+
+// jsonrpc calls method on the server, following redirects to the current
+// leader when the servers are replicated.
 func (server *ServerConn) jsonrpc(method string, params interface{}) (interface{}, error) {
-	connRaw, err := net.Dial("tcp", server.conn_str.String())
+	for {
+		r := server.call(method, params)
+		if r.Error == nil {
+			return r.Result, nil
+		}
+		if e, ok := r.Error.(map[string]interface{}); ok && e["code"] == float64(-32003) {
+			if data, ok := e["data"].(map[string]interface{}); ok && data["leader"] != "" {
+				if addr, err := net.ResolveTCPAddr("tcp", fmt.Sprint(data["leader"])); err == nil {
+					log.Println("Redirected to leader", addr)
+					server.mutex.Lock()
+					server.conn_str = addr
+					server.mutex.Unlock()
+					continue
+				}
+			}
+			// no leader yet, wait for the election
+			time.Sleep(time.Second)
+			continue
+		}
+		return nil, errors.New(fmt.Sprint(r.Error))
+	}
+}
+
+func (server *ServerConn) call(method string, params interface{}) resp {
+	connRaw, err := net.Dial("tcp", server.addr().String())
 	if err != nil {
 		log.Panic(err)
 	}
@@ -96,10 +140,7 @@ func (server *ServerConn) jsonrpc(method string, params interface{}) (interface{
 	if err != nil {
 		log.Panic("json decoding response", err)
 	}
-	if r.Error != nil {
-		return nil, errors.New(fmt.Sprint(r.Error))
-	}
-	return r.Result, nil
+	return r
 }
 
 func gen_csv(csvFile string) (records [][]string, err error) {
@@ -118,8 +159,14 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	ServerStr := flag.String("srv", "localhost:3333", "server hostname")
 	csvFile := flag.String("csv", "mjerenja.csv", "Location of csv file")
+	keyFile := flag.String("key", "klijent.key", "Location of the signing key, created if missing")
 	flag.Parse()
 
+	key, err := Signature.LoadOrCreateKey(*keyFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
 	rec, err := gen_csv(*csvFile)
 	server, err := net.ResolveTCPAddr("tcp", *ServerStr)
 	if err != nil {
@@ -130,10 +177,15 @@ func main() {
 		id:       1,
 	}
 
-	ctx, err := genDesc()
+	ctx, err := genDesc(key)
 	if err != nil {
 		log.Panic(err)
 	}
+	for _, param := range rec[0] {
+		if param != "" {
+			ctx.Params = append(ctx.Params, param)
+		}
+	}
 
 	if ln, err := net.Listen("tcp", ":0"); err != nil {
 		log.Panic(err)
@@ -147,8 +199,14 @@ func main() {
 		log.Panic(err)
 	} else {
 		log.Println(resp)
+		// carry on from the last measurement stored under our username
+		if seq, ok := resp.(map[string]interface{})["seq"].(float64); ok {
+			ctx.seq = uint64(seq)
+		}
 	}
 	testRPC(srv, ctx)
+	go heartbeat(srv, ctx)
+	go unregisterOnInterrupt(srv, ctx)
 
 	getNeighbour(srv, ctx)
 
@@ -196,7 +254,8 @@ func fetchNeighbourMeasurement(ctx *Context, srv *ServerConn) (map[string]float6
 }
 
 func readMeasurement(startTime time.Time, rec [][]string, ctx *Context, srv *ServerConn) {
-	elapsedSeconds := time.Now().Sub(startTime).Seconds()
+	measuredAt := time.Now()
+	elapsedSeconds := measuredAt.Sub(startTime).Seconds()
 	no := (int(elapsedSeconds) % 100) + 2
 	log.Printf("Elapsed seconds %f, field %d, data %s\n", elapsedSeconds, no, rec[no])
 	data := func() map[string]float64 {
@@ -235,20 +294,33 @@ func readMeasurement(startTime time.Time, rec [][]string, ctx *Context, srv *Ser
 		}
 	}
 
+	measurements := []map[string]interface{}{}
 	for param, val := range data {
-		if resp, err := srv.jsonrpc("storeMeasurement", map[string]interface{}{
-			"username":     ctx.Username,
+		ctx.seq++
+		measurements = append(measurements, map[string]interface{}{
 			"param":        param,
 			"averageValue": val,
-		}); err != nil {
-			log.Panic(err)
-		} else {
-			log.Println("Got", resp)
-		}
+			"seq":          ctx.seq,
+			"signature":    Signature.Sign(ctx.key, ctx.Username, param, val, measuredAt, ctx.seq),
+		})
+	}
+	if resp, err := srv.jsonrpc("storeMeasurements", map[string]interface{}{
+		"username":     ctx.Username,
+		"measuredAt":   measuredAt.Format(time.RFC3339Nano),
+		"measurements": measurements,
+	}); err != nil {
+		log.Panic(err)
+	} else {
+		log.Println("Got", resp)
 	}
 }
 func getNeighbour(srv *ServerConn, desc *Context) (*net.TCPAddr, error) {
-	if resp, err := srv.jsonrpc("search", map[string]string{"username": desc.Username}); err != nil {
+	// a neighbour is only useful if it measures what we do
+	if resp, err := srv.jsonrpc("search", map[string]interface{}{
+		"username": desc.Username,
+		"params":   desc.Params,
+		"fallback": "most",
+	}); err != nil {
 		log.Panic(err)
 		return nil, err
 	} else {
@@ -269,6 +341,38 @@ func getNeighbour(srv *ServerConn, desc *Context) (*net.TCPAddr, error) {
 	}
 }
 
+// leaseCall sends a heartbeat or unregister signed for now.
+func leaseCall(srv *ServerConn, desc *Context, op string) (interface{}, error) {
+	at := time.Now()
+	return srv.jsonrpc(op, map[string]interface{}{
+		"username":  desc.Username,
+		"at":        at.Format(time.RFC3339Nano),
+		"signature": Signature.SignLease(desc.key, op, desc.Username, at),
+	})
+}
+
+// heartbeat keeps the registration alive while measurements are not coming
+// through.
+func heartbeat(srv *ServerConn, desc *Context) {
+	for range time.Tick(10 * time.Second) {
+		if resp, err := leaseCall(srv, desc, "heartbeat"); err != nil {
+			log.Println(err)
+		} else {
+			log.Println("Lease", resp)
+		}
+	}
+}
+
+func unregisterOnInterrupt(srv *ServerConn, desc *Context) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	if _, err := leaseCall(srv, desc, "unregister"); err != nil {
+		log.Println(err)
+	}
+	os.Exit(0)
+}
+
 func testRPC(srv *ServerConn, desc *Context) {
 	if resp, err := srv.jsonrpc("test", map[string]string{"username": desc.Username}); err != nil {
 		log.Panic(err)
@@ -1,85 +1,505 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
+	"crypto/ed25519"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"math"
+	"log"
 	"sync"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+	"github.com/nmiculinic/rassus/dz1/Signature"
 )
 
+// Measurement is a single signed sensor reading inside a Block.
+type Measurement struct {
+	Username string
+	Param    string
+	Value    float64
+	Measured time.Time // when the sensor took it, zero if not reported
+	Seq      uint64
+	Sig      []byte // sensor's signature over username, param, value, measured and seq
+}
+
+func (m *Measurement) hash() []byte {
+	return Chain.MeasurementHash(m.Username, m.Param, m.Value, m.Measured, m.Seq, m.Sig)
+}
+
 type Block struct {
-	last     *Block
-	username string
-	param    string
-	value    float64
-	id       int
-	hash     []byte
+	prev         []byte // hash of the previous block, kept after it is pruned
+	measurements []Measurement
+	root         []byte    // Merkle root over the measurement hashes
+	snapshot     *Snapshot // set on checkpoint blocks only
+	id           int
+	time         time.Time // when the server received the measurements
+	difficulty   int       // leading zero bits the hash must have
+	nonce        uint64
+	hash         []byte
 }
 
-func (blk *Block) Append(username string, parameter string, value float64) (*Block, error) {
+// Append links a new block after blk using the given nonce; call mine to
+// search for one that satisfies the difficulty.
+func (blk *Block) Append(measurements []Measurement, at time.Time, difficulty int, nonce uint64) (*Block, error) {
+	if len(measurements) == 0 {
+		return nil, errors.New("Block without measurements")
+	}
 	sol := &Block{
-		last:     blk,
-		username: username,
-		param:    parameter,
-		value:    value,
-		id:       blk.id + 1,
-	}
-	h := sha256.New()
-	h.Write([]byte(sol.username))
-	h.Write([]byte(sol.param))
-	var buf [8]byte
-	binary.BigEndian.PutUint64(buf[:], math.Float64bits(sol.value))
-	h.Write(buf[:])
-	if sol.last != nil {
-		h.Write(sol.last.hash)
-	}
-	sol.hash = h.Sum(nil)
+		prev:         blk.hash,
+		measurements: measurements,
+		id:           blk.id + 1,
+		time:         at,
+		difficulty:   difficulty,
+		nonce:        nonce,
+	}
+	sol.root = Chain.MerkleRoot(sol.leaves())
+	sol.hash = sol.computeHash()
 	return sol, nil
 }
 
-func (blk *Block) getBlock(i int) (*Block, error) {
-	if blk.id < i || i < 0 {
-		return nil, errors.New(fmt.Sprint("No such id!", i))
+func (blk *Block) leaves() [][]byte {
+	sol := make([][]byte, len(blk.measurements))
+	for i := range blk.measurements {
+		sol[i] = blk.measurements[i].hash()
 	}
-	for blk.id != i {
-		blk = blk.last
+	return sol
+}
+
+func (blk *Block) computeHash() []byte {
+	var digest, sig []byte
+	if blk.snapshot != nil {
+		digest, sig = blk.snapshotDigest(), blk.snapshot.Sig
 	}
-	return blk, nil
+	return Chain.BlockHash(blk.root, blk.id, blk.time, blk.difficulty, blk.nonce, digest, sig, blk.prev)
 }
 
-func (blk *Block) getState() (map[string]map[string]float64, error) {
-	sol := make(map[string]map[string]float64)
-	curr := blk
-	for curr != nil && curr.last != nil {
-		val, ok := sol[curr.username]
+var LastBlock *Block = &Block{id: 0}
+var blockMuter sync.Mutex
+var blockLog *BlockLog
+
+// blocks indexes the chain by id. blocks[0] is genesis, or the checkpoint
+// block everything older was pruned to, so block id sits at id-blocks[0].id.
+var blocks = []*Block{LastBlock}
+
+// latest holds the newest value of every (username, param) pair in the chain,
+// kept in step with LastBlock under blockMuter.
+var latest = make(map[string]map[string]float64)
+
+// seqs holds the highest sequence number stored for every username, so a
+// signed measurement cannot be replayed.
+var seqs = make(map[string]uint64)
+
+// latestAt holds when the server received every value in latest; rules go by
+// it rather than by the time a sensor claims. Values carried over from a
+// checkpoint have none.
+var latestAt = make(map[string]map[string]time.Time)
+
+func updateState(state map[string]map[string]float64, blk *Block) {
+	for _, m := range blk.measurements {
+		val, ok := state[m.Username]
 		if !ok {
-			sol[curr.username] = make(map[string]float64)
-			val = sol[curr.username]
+			val = make(map[string]float64)
+			state[m.Username] = val
 		}
-		if _, ok := val[curr.param]; !ok {
-			val[curr.param] = curr.value
+		val[m.Param] = m.Value
+	}
+}
+
+func copyState(state map[string]map[string]float64) map[string]map[string]float64 {
+	sol := make(map[string]map[string]float64, len(state))
+	for username, params := range state {
+		sol[username] = make(map[string]float64, len(params))
+		for param, value := range params {
+			sol[username][param] = value
 		}
-		curr = curr.last
 	}
-	return sol, nil
+	return sol
 }
 
-var LastBlock *Block = &Block{id: 0}
-var blockMuter sync.Mutex
+// apply folds a freshly linked block into latest and the checkpoints.
+func apply(blk *Block) {
+	blocks = append(blocks, blk)
+	updateState(latest, blk)
+	for _, m := range blk.measurements {
+		seqs[m.Username] = m.Seq
+		if latestAt[m.Username] == nil {
+			latestAt[m.Username] = make(map[string]time.Time)
+		}
+		latestAt[m.Username][m.Param] = blk.time
+	}
+	if blk.snapshot != nil || blk.id%checkpointInterval == 0 {
+		checkpoints = append(checkpoints, checkpoint{block: blk, state: copyState(latest)})
+	}
+}
+
+// LoadChain replaces the in-memory chain with the one stored at path; every
+// block appended afterwards is written there as well.
+func LoadChain(path string) error {
+	blockMuter.Lock()
+	defer blockMuter.Unlock()
+	l, chain, err := OpenBlockLog(path)
+	if err != nil {
+		return err
+	}
+	blockLog = l
+	reset(chain)
+	return nil
+}
+
+// reset replaces the in-memory chain with chain, which starts at genesis or
+// at a checkpoint block; the caller holds blockMuter.
+func reset(chain []*Block) {
+	base := chain[0]
+	blocks = []*Block{base}
+	latest = make(map[string]map[string]float64)
+	latestAt = make(map[string]map[string]time.Time)
+	seqs = make(map[string]uint64)
+	if base.snapshot != nil {
+		latest = copyState(base.snapshot.State)
+		for username, seq := range base.snapshot.Seqs {
+			seqs[username] = seq
+		}
+	}
+	checkpoints = []checkpoint{{block: base, state: copyState(latest)}}
+	for _, blk := range chain[1:] {
+		apply(blk)
+	}
+	LastBlock = chain[len(chain)-1]
+}
+
+// ImportBlocks appends exported blocks after the tip, checking each one the
+// way the block log replay does, and that it carries at least -difficulty,
+// and its measurements the way new ones are: in sequence, passing the
+// validator and, for the sensors keys holds a key of, signed with it. An
+// export carries no keys, so the measurements of sensors this server has
+// never seen are taken on the strength of the hashes and proof-of-work
+// alone. A server holding nothing but genesis also takes an export that
+// starts at a checkpoint block, which becomes its base. It returns the new
+// tip; blocks before a bad one stay imported.
+func ImportBlocks(recs []Chain.Record, keys map[string]ed25519.PublicKey) (*Block, error) {
+	blockMuter.Lock()
+	defer blockMuter.Unlock()
+	for i := range recs {
+		if recs[i].Id == 0 {
+			// genesis, every chain has it
+			continue
+		}
+		tip := LastBlock
+		blk, err := nextBlock(tip, &recs[i], tip.id == 0, difficulty)
+		if err != nil {
+			return LastBlock, err
+		}
+		if blk.id != tip.id+1 {
+			if blockLog != nil {
+				if err := blockLog.Rewrite([]*Block{blk}); err != nil {
+					return LastBlock, err
+				}
+			}
+			reset([]*Block{blk})
+			notify(blk)
+			continue
+		}
+		if err := checkMeasurements(blk, keys); err != nil {
+			return LastBlock, err
+		}
+		if err := link(blk); err != nil {
+			return LastBlock, err
+		}
+	}
+	return LastBlock, nil
+}
+
+// RestoreChain replaces the chain with recs, which start at genesis or at a
+// checkpoint block, checking every block the way the block log replay does,
+// and rewrites the block log to match.
+func RestoreChain(recs []Chain.Record) error {
+	chain := []*Block{{id: 0}}
+	for i := range recs {
+		if recs[i].Id == 0 {
+			continue
+		}
+		tip := chain[len(chain)-1]
+		blk, err := nextBlock(tip, &recs[i], tip.id == 0, 0)
+		if err != nil {
+			return err
+		}
+		if blk.id != tip.id+1 {
+			chain = chain[:0]
+		}
+		chain = append(chain, blk)
+	}
+	blockMuter.Lock()
+	defer blockMuter.Unlock()
+	if blockLog != nil {
+		if err := blockLog.Rewrite(chain); err != nil {
+			return err
+		}
+	}
+	reset(chain)
+	return nil
+}
+
+// checkMeasurements checks the measurements of blk, which is to follow the
+// tip, against the keys it has, the stored sequence numbers and the validator; the
+// caller holds blockMuter.
+func checkMeasurements(blk *Block, keys map[string]ed25519.PublicKey) error {
+	last := make(map[string]uint64)
+	pending := make(map[string]reading)
+	for i := range blk.measurements {
+		m := &blk.measurements[i]
+		if key, ok := keys[m.Username]; ok && !Signature.Verify(key, m.Sig, m.Username, m.Param, m.Value, m.Measured, m.Seq) {
+			return errors.New(fmt.Sprintf("block %d: Invalid signature for %s from %s", blk.id, m.Param, m.Username))
+		}
+		seq, ok := last[m.Username]
+		if !ok {
+			seq, ok = seqs[m.Username]
+		}
+		if ok && m.Seq <= seq {
+			return errors.New(fmt.Sprintf("block %d: Stale sequence number %d for %s, last stored is %d", blk.id, m.Seq, m.Username, seq))
+		}
+		last[m.Username] = m.Seq
+
+		r, ok := pending[m.Username+"\x00"+m.Param]
+		if !ok {
+			r.Previous, r.HasPrevious = latest[m.Username][m.Param]
+			r.PreviousAt = latestAt[m.Username][m.Param]
+		}
+		r.Known = true
+		r.At = blk.time
+		if err := validator.Validate(m, &r); err != nil {
+			return err
+		}
+		pending[m.Username+"\x00"+m.Param] = reading{Previous: m.Value, PreviousAt: r.At, HasPrevious: true}
+	}
+	return nil
+}
 
 func PeekLast() *Block {
 	return LastBlock
 }
 
-func Append(username string, parameter string, value float64) (*Block, error) {
+// Append stores measurements whose signatures the caller has already checked
+// in a single block received at server time at.
+func Append(measurements []Measurement, at time.Time, difficulty int) (*Block, error) {
+	sol, err := mineAndLink(func(tip *Block) (*Block, error) {
+		pending := make(map[string]uint64)
+		for _, m := range measurements {
+			last, ok := pending[m.Username]
+			if !ok {
+				last, ok = seqs[m.Username]
+			}
+			if ok && m.Seq <= last {
+				return nil, errors.New(fmt.Sprintf("Stale sequence number %d for %s, last stored is %d", m.Seq, m.Username, last))
+			}
+			pending[m.Username] = m.Seq
+		}
+		blkAt := at
+		if blkAt.Before(tip.time) {
+			// keep block times ordered so they can be searched
+			blkAt = tip.time
+		}
+		return tip.Append(measurements, blkAt, difficulty, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if checkpointEvery > 0 && sol.id%checkpointEvery == 0 {
+		if err := emitCheckpoint(sol.time, difficulty); err != nil {
+			// the measurements are stored, the next checkpoint will do
+			log.Println("Checkpoint failed:", err)
+		}
+	}
+	return sol, nil
+}
+
+// mineAndLink mines the block next makes on top of the tip and links it.
+// blockMuter is only held while next runs and while linking, so reads go on
+// while the block is mined; when another block was linked in the meantime it
+// starts over on the new tip.
+func mineAndLink(next func(tip *Block) (*Block, error)) (*Block, error) {
+	for {
+		blockMuter.Lock()
+		tip := LastBlock
+		sol, err := next(tip)
+		blockMuter.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		attempts := sol.mine()
+		took := time.Since(start)
+
+		blockMuter.Lock()
+		if LastBlock != tip {
+			blockMuter.Unlock()
+			continue
+		}
+		err = link(sol)
+		blockMuter.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		recordMining(sol.difficulty, attempts, took)
+		return sol, nil
+	}
+}
+
+// link makes blk the new tip; the caller holds blockMuter.
+func link(blk *Block) error {
+	if blockLog != nil {
+		if err := blockLog.Write(blk); err != nil {
+			return err
+		}
+	}
+	LastBlock = blk
+	apply(blk)
+	notify(blk)
+	return nil
+}
+
+// GetState returns a copy of the latest value per (username, param). Its cost
+// depends on the number of sensors, not on the length of the chain.
+func GetState() map[string]map[string]float64 {
+	blockMuter.Lock()
+	defer blockMuter.Unlock()
+	return copyState(latest)
+}
+
+// LastSeq returns the highest sequence number stored for username, 0 if
+// there is none.
+func LastSeq(username string) uint64 {
+	blockMuter.Lock()
+	defer blockMuter.Unlock()
+	return seqs[username]
+}
+
+// Previous returns the newest stored value of param from username and when
+// it was received, zero if that is unknown.
+func Previous(username, param string) (float64, time.Time, bool) {
+	blockMuter.Lock()
+	defer blockMuter.Unlock()
+	value, ok := latest[username][param]
+	return value, latestAt[username][param], ok
+}
+
+// blockIndex returns where block id sits in chain.
+func blockIndex(chain []*Block, id int) (int, error) {
+	i := id - chain[0].id
+	if i < 0 && id >= 0 {
+		return 0, errors.New(fmt.Sprintf("Block %d was pruned, the chain starts at %d", id, chain[0].id))
+	}
+	if i < 0 || i >= len(chain) {
+		return 0, errors.New(fmt.Sprint("No such id!", id))
+	}
+	return i, nil
+}
+
+func GetBlock(id int) (*Block, error) {
 	blockMuter.Lock()
 	defer blockMuter.Unlock()
-	sol, err := LastBlock.Append(username, parameter, value)
+	i, err := blockIndex(blocks, id)
 	if err != nil {
 		return nil, err
 	}
-	LastBlock = sol
+	return blocks[i], nil
+}
+
+// GetBlocks returns blocks from..to inclusive, at most limit of them.
+func GetBlocks(from, to, limit int) ([]*Block, error) {
+	blockMuter.Lock()
+	defer blockMuter.Unlock()
+	first, err := blockIndex(blocks, from)
+	if err != nil {
+		return nil, err
+	}
+	last := to - blocks[0].id
+	if last >= len(blocks) {
+		last = len(blocks) - 1
+	}
+	if last-first+1 > limit {
+		last = first + limit - 1
+	}
+	if last < first {
+		return []*Block{}, nil
+	}
+	return blocks[first : last+1], nil
+}
+
+// VerifyChain re-hashes the chain from its base, checkpoint signatures
+// included, the same way an auditor does with an export. Blocks are held to
+// the difficulty they record, not to -difficulty, which may have been raised
+// since they were mined.
+func VerifyChain() Chain.Report {
+	blockMuter.Lock()
+	chain := blocks
+	blockMuter.Unlock()
+	recs := make([]Chain.Record, len(chain))
+	for i, blk := range chain {
+		recs[i] = blk.record()
+	}
+	return Chain.Verify(recs, serverKey.Public().(ed25519.PublicKey), 0)
+}
+
+// Receipt tells a client which block holds its measurements.
+type Receipt struct {
+	Id   int       `json:"id"`
+	Hash string    `json:"hash"`
+	Prev string    `json:"prev"`
+	Time time.Time `json:"time"`
+	// Confirmations counts the blocks linked after this one.
+	Confirmations int `json:"confirmations"`
+}
+
+func (blk *Block) receipt() *Receipt {
+	return &Receipt{
+		Id:   blk.id,
+		Hash: hex.EncodeToString(blk.hash),
+		Prev: hex.EncodeToString(blk.prev),
+		Time: blk.time,
+	}
+}
+
+// GetReceipt checks that block id still has the given hash, so a receipt
+// handed out earlier is part of the chain, and returns it up to date.
+func GetReceipt(id int, hash string) (*Receipt, error) {
+	blk, err := GetBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	sol := blk.receipt()
+	if sol.Hash != hash {
+		return nil, errors.New(fmt.Sprintf("Block %d has hash %s, not %s", id, sol.Hash, hash))
+	}
+	sol.Confirmations = PeekLast().id - id
 	return sol, nil
 }
+
+// MerkleProof proves that one measurement is part of block Id.
+type MerkleProof struct {
+	Block Chain.Record      `json:"block"`
+	Index int               `json:"index"`
+	Leaf  string            `json:"leaf"`
+	Proof []Chain.ProofStep `json:"proof"`
+}
+
+// GetProof returns an inclusion proof for the measurement with the given
+// username and sequence number in block id.
+func GetProof(id int, username string, seq uint64) (*MerkleProof, error) {
+	blk, err := GetBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range blk.measurements {
+		if m.Username == username && m.Seq == seq {
+			leaves := blk.leaves()
+			return &MerkleProof{
+				Block: blk.record(),
+				Index: i,
+				Leaf:  hex.EncodeToString(leaves[i]),
+				Proof: Chain.MerkleProof(leaves, i),
+			}, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("No measurement %d from %s in block %d", seq, username, id))
+}
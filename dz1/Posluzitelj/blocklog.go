@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+)
+
+// record is the on-disk and wire form of blk.
+func (blk *Block) record() Chain.Record {
+	sol := Chain.Record{
+		Id:           blk.id,
+		Time:         blk.time,
+		Measurements: make([]Chain.MeasurementRecord, len(blk.measurements)),
+		Root:         hex.EncodeToString(blk.root),
+		Difficulty:   blk.difficulty,
+		Nonce:        blk.nonce,
+		Hash:         hex.EncodeToString(blk.hash),
+	}
+	for i, m := range blk.measurements {
+		sol.Measurements[i] = Chain.MeasurementRecord{
+			Username: m.Username,
+			Param:    m.Param,
+			Value:    m.Value,
+			Seq:      m.Seq,
+			Sig:      hex.EncodeToString(m.Sig),
+		}
+		if !m.Measured.IsZero() {
+			measured := m.Measured
+			sol.Measurements[i].Measured = &measured
+		}
+	}
+	if blk.snapshot != nil {
+		sol.Snapshot = &Chain.SnapshotRecord{
+			State: blk.snapshot.State,
+			Seqs:  blk.snapshot.Seqs,
+			Sig:   hex.EncodeToString(blk.snapshot.Sig),
+		}
+	}
+	sol.Prev = hex.EncodeToString(blk.prev)
+	return sol
+}
+
+func recordMeasurements(rec *Chain.Record) ([]Measurement, error) {
+	sol := make([]Measurement, len(rec.Measurements))
+	for i, m := range rec.Measurements {
+		sig, err := hex.DecodeString(m.Sig)
+		if err != nil {
+			return nil, err
+		}
+		sol[i] = Measurement{
+			Username: m.Username,
+			Param:    m.Param,
+			Value:    m.Value,
+			Seq:      m.Seq,
+			Sig:      sig,
+		}
+		if m.Measured != nil {
+			sol[i].Measured = *m.Measured
+		}
+	}
+	return sol, nil
+}
+
+// recordBlock rebuilds the block rec describes on top of tip.
+func recordBlock(rec *Chain.Record, tip *Block) (*Block, error) {
+	if rec.Snapshot != nil {
+		sig, err := hex.DecodeString(rec.Snapshot.Sig)
+		if err != nil {
+			return nil, err
+		}
+		snapshot := &Snapshot{State: rec.Snapshot.State, Seqs: rec.Snapshot.Seqs, Sig: sig}
+		if snapshot.State == nil {
+			snapshot.State = make(map[string]map[string]float64)
+		}
+		if snapshot.Seqs == nil {
+			snapshot.Seqs = make(map[string]uint64)
+		}
+		return tip.Checkpoint(snapshot, rec.Time, rec.Difficulty, rec.Nonce, nil), nil
+	}
+	measurements, err := recordMeasurements(rec)
+	if err != nil {
+		return nil, err
+	}
+	return tip.Append(measurements, rec.Time, rec.Difficulty, rec.Nonce)
+}
+
+// nextBlock rebuilds the block rec describes on top of tip and checks it
+// against everything rec claims, that it claims at least minDifficulty and
+// that it was not received before tip, which searching by time relies on.
+// When first is set, a checkpoint block may stand in for everything before
+// it, as it does at the start of a pruned log; the returned block then does
+// not follow tip.
+func nextBlock(tip *Block, rec *Chain.Record, first bool, minDifficulty int) (*Block, error) {
+	if first && rec.Snapshot != nil && rec.Id > tip.id+1 {
+		prev, err := hex.DecodeString(rec.Prev)
+		if err != nil {
+			return nil, err
+		}
+		tip = &Block{id: rec.Id - 1, hash: prev}
+	}
+	if rec.Id != tip.id+1 {
+		return nil, errors.New(fmt.Sprintf("expected block %d, got %d", tip.id+1, rec.Id))
+	}
+	if rec.Prev != hex.EncodeToString(tip.hash) {
+		return nil, errors.New(fmt.Sprintf("block %d does not link to block %d", rec.Id, tip.id))
+	}
+	if rec.Time.Before(tip.time) {
+		return nil, errors.New(fmt.Sprintf("block %d is from %s, before block %d", rec.Id, rec.Time.Format(time.RFC3339Nano), tip.id))
+	}
+	blk, err := recordBlock(rec, tip)
+	if err != nil {
+		return nil, err
+	}
+	if root := hex.EncodeToString(blk.root); root != rec.Root {
+		return nil, errors.New(fmt.Sprintf("block %d Merkle root mismatch, stored %s, computed %s", rec.Id, rec.Root, root))
+	}
+	if hash := hex.EncodeToString(blk.hash); hash != rec.Hash {
+		return nil, errors.New(fmt.Sprintf("block %d hash mismatch, stored %s, computed %s", rec.Id, rec.Hash, hash))
+	}
+	if rec.Difficulty < minDifficulty {
+		return nil, errors.New(fmt.Sprintf("block %d has difficulty %d, at least %d is required", rec.Id, rec.Difficulty, minDifficulty))
+	}
+	if !Chain.MeetsDifficulty(blk.hash, blk.difficulty) {
+		return nil, errors.New(fmt.Sprintf("block %d does not meet difficulty %d", rec.Id, rec.Difficulty))
+	}
+	if blk.snapshot != nil && !blk.snapshot.valid(blk) {
+		return nil, errors.New(fmt.Sprintf("checkpoint block %d has a bad signature", rec.Id))
+	}
+	return blk, nil
+}
+
+// BlockLog is an append-only file holding every block after genesis, or
+// after the checkpoint block it was pruned to.
+type BlockLog struct {
+	f    *os.File
+	path string
+}
+
+// OpenBlockLog opens (or creates) the log at path and rebuilds the chain by
+// replaying and re-hashing every stored block. It refuses a log whose last
+// line is cut short or whose blocks do not link up. The returned chain starts
+// at genesis or at the checkpoint block the log was pruned to.
+func OpenBlockLog(path string) (*BlockLog, []*Block, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, err := replay(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+	return &BlockLog{f: f, path: path}, chain, nil
+}
+
+func replay(r io.Reader) ([]*Block, error) {
+	reader := bufio.NewReader(r)
+	chain := []*Block{{id: 0}}
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(data)) != 0 {
+				return nil, errors.New(fmt.Sprint("truncated block at line ", line))
+			}
+			return chain, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec := Chain.Record{}
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %s", line, err))
+		}
+		tip := chain[len(chain)-1]
+		// blocks mined before -difficulty was raised only need the work
+		// they record
+		blk, err := nextBlock(tip, &rec, line == 1, 0)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %s", line, err))
+		}
+		if blk.id != tip.id+1 {
+			chain = chain[:0]
+		}
+		chain = append(chain, blk)
+	}
+}
+
+func writeBlocks(w io.Writer, blks []*Block) error {
+	for _, blk := range blks {
+		if blk.id == 0 {
+			continue
+		}
+		b, err := json.Marshal(blk.record())
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Archive writes blks to a cold file next to the log, named after the range
+// of ids it holds, in the same format as the log itself.
+func (l *BlockLog) Archive(blks []*Block) error {
+	path := fmt.Sprintf("%s.%d-%d", l.path, blks[0].id, blks[len(blks)-1].id)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := writeBlocks(f, blks); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Rewrite replaces the log with blks. The new log is synced before it is
+// renamed over the old one, so a crash leaves one or the other.
+func (l *BlockLog) Rewrite(blks []*Block) error {
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeBlocks(f, blks); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		f.Close()
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	return nil
+}
+
+// Write appends blk to the log and syncs it to disk before returning.
+func (l *BlockLog) Write(blk *Block) error {
+	b, err := json.Marshal(blk.record())
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *BlockLog) Close() error {
+	return l.f.Close()
+}
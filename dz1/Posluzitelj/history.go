@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// checkpointInterval is how many blocks apart state snapshots are taken.
+const checkpointInterval = 100
+
+type checkpoint struct {
+	block *Block
+	state map[string]map[string]float64
+}
+
+// checkpoints always starts with the chain's base block and is ordered by
+// block id. Checkpoint blocks are always in it.
+var checkpoints = []checkpoint{{block: LastBlock, state: make(map[string]map[string]float64)}}
+
+// stateAt rebuilds the state as of block id from the nearest checkpoint at or
+// before it, so at most checkpointInterval blocks are replayed.
+func stateAt(chain []*Block, cps []checkpoint, id int) (map[string]map[string]float64, error) {
+	end, err := blockIndex(chain, id)
+	if err != nil {
+		return nil, err
+	}
+	// first checkpoint past id, the one before it is the base
+	i := sort.Search(len(cps), func(i int) bool { return cps[i].block.id > id })
+	base := cps[i-1]
+	sol := copyState(base.state)
+	for _, blk := range chain[base.block.id-chain[0].id+1 : end+1] {
+		updateState(sol, blk)
+	}
+	return sol, nil
+}
+
+// indexAtTime returns where in chain the last block received at or before t
+// sits, or 0 when t predates the whole chain.
+func indexAtTime(chain []*Block, t time.Time) int {
+	i := sort.Search(len(chain), func(i int) bool {
+		return i > 0 && chain[i].time.After(t)
+	})
+	return i - 1
+}
+
+// GetStateAt returns the username->param->value map as it was right after
+// block id.
+func GetStateAt(id int) (map[string]map[string]float64, error) {
+	blockMuter.Lock()
+	chain, cps := blocks, checkpoints
+	blockMuter.Unlock()
+	return stateAt(chain, cps, id)
+}
+
+// GetStateAtTime returns the state as it was at server time t.
+func GetStateAtTime(t time.Time) (map[string]map[string]float64, error) {
+	blockMuter.Lock()
+	chain, cps := blocks, checkpoints
+	blockMuter.Unlock()
+	if chain[0].id > 0 && t.Before(chain[0].time) {
+		return nil, errors.New(fmt.Sprintf("State at %s was pruned, the chain starts at %s", t, chain[0].time))
+	}
+	return stateAt(chain, cps, chain[indexAtTime(chain, t)].id)
+}
+
+// GetBlocksByTime returns up to limit blocks received by the server within
+// [from, to].
+func GetBlocksByTime(from, to time.Time, limit int) ([]*Block, error) {
+	blockMuter.Lock()
+	chain := blocks
+	blockMuter.Unlock()
+	if to.Before(from) {
+		return nil, errors.New(fmt.Sprint("Empty time range ", from, " - ", to))
+	}
+	first := sort.Search(len(chain), func(i int) bool {
+		return i > 0 && !chain[i].time.Before(from)
+	})
+	last := indexAtTime(chain, to) + 1
+	if last-first > limit {
+		last = first + limit
+	}
+	if last < first {
+		return []*Block{}, nil
+	}
+	return chain[first:last], nil
+}
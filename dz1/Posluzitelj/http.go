@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHTTPBody bounds the size of a POST /rpc request.
+const maxHTTPBody = 16 << 20
+
+// How long a client gets to send its request headers, its whole request,
+// and to send another over a kept-alive connection. A WebSocket clears them
+// once it takes the connection over.
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpReadTimeout       = time.Minute
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+// gateway serves the JSON-RPC methods over HTTP, plus read-only resources
+// for tools that would rather GET:
+//
+//	POST /rpc                 a JSON-RPC request or batch
+//	GET  /sensors             the registered sensors
+//	GET  /sensors/{username}  one sensor
+//	GET  /blocks/{id}         one block
+//	GET  /state               the newest values, or as of ?id= or ?time=
+//	GET  /ws                  JSON-RPC over a WebSocket, notifications included
+//
+// Web pages from origins may call the others from a browser.
+type gateway struct {
+	registry *Registry
+	state    *SensorState
+	origins  []string // "*" allows every origin
+}
+
+func newGateway(registry *Registry, state *SensorState, origins []string) http.Handler {
+	g := &gateway{registry: registry, state: state, origins: origins}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rpc", g.cors(http.MethodPost, g.rpc))
+	mux.HandleFunc("/sensors", g.cors(http.MethodGet, g.sensors))
+	mux.HandleFunc("/sensors/", g.cors(http.MethodGet, g.sensor))
+	mux.HandleFunc("/blocks/", g.cors(http.MethodGet, g.block))
+	mux.HandleFunc("/state", g.cors(http.MethodGet, g.currentState))
+	mux.HandleFunc("/ws", g.websocket)
+	return mux
+}
+
+// serveHTTP serves the gateway on addr until it fails.
+func serveHTTP(addr string, handler http.Handler) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		ReadTimeout:       httpReadTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	return srv.ListenAndServe()
+}
+
+// allowedOrigin tells whether a page from origin may call the gateway.
+func (g *gateway) allowedOrigin(origin string) bool {
+	for _, o := range g.origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// cors lets allowed origins read what handle answers, and answers their
+// browsers' preflight OPTIONS requests for method itself.
+func (g *gateway) cors(method string, handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		allowed := origin != "" && g.allowedOrigin(origin)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
+		if req.Method != http.MethodOptions {
+			handle(w, req)
+			return
+		}
+		w.Header().Set("Allow", method+", "+http.MethodOptions)
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", method)
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		status, b = http.StatusInternalServerError, []byte(`{"error":"Internal error"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// allow answers 405 unless the request uses method.
+func allow(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, req.Method+" not allowed")
+		return false
+	}
+	return true
+}
+
+// rpc runs a JSON-RPC request like a line from a TCP connection. There is
+// no connection to push notifications over, so subscriptions are refused.
+func (g *gateway) rpc(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodPost) {
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxHTTPBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	sol, after := g.registry.answer(body, nil)
+	for _, f := range after {
+		go f()
+	}
+	if sol == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, sol)
+}
+
+func (g *gateway) sensors(w http.ResponseWriter, req *http.Request) {
+	if allow(w, req, http.MethodGet) {
+		writeJSON(w, http.StatusOK, g.state.listSensors())
+	}
+}
+
+func (g *gateway) sensor(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodGet) {
+		return
+	}
+	username := strings.TrimPrefix(req.URL.Path, "/sensors/")
+	g.state.mutex.Lock()
+	v := g.state.sensor(username, time.Now())
+	g.state.mutex.Unlock()
+	if v == nil {
+		writeError(w, http.StatusNotFound, "No sensor "+username)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (g *gateway) block(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodGet) {
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/blocks/"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Block id must be a number")
+		return
+	}
+	blk, err := GetBlock(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, blk.record())
+}
+
+func (g *gateway) currentState(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodGet) {
+		return
+	}
+	var sol map[string]map[string]float64
+	var err error
+	query := req.URL.Query()
+	switch {
+	case query.Get("id") != "":
+		id, convErr := strconv.Atoi(query.Get("id"))
+		if convErr != nil {
+			writeError(w, http.StatusBadRequest, "id must be a number")
+			return
+		}
+		sol, err = GetStateAt(id)
+	case query.Get("time") != "":
+		at, parseErr := time.Parse(time.RFC3339Nano, query.Get("time"))
+		if parseErr != nil {
+			writeError(w, http.StatusBadRequest, "time must be an RFC 3339 time")
+			return
+		}
+		sol, err = GetStateAtTime(at)
+	default:
+		sol = GetState()
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sol)
+}
+
+// listSensors returns the live sensors by username.
+func (state *SensorState) listSensors() []*Vertex {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	now := time.Now()
+	sol := []*Vertex{}
+	for _, v := range state.sensors {
+		if !v.expired(now) {
+			sol = append(sol, v)
+		}
+	}
+	sort.Slice(sol, func(i, j int) bool { return sol[i].Username < sol[j].Username })
+	return sol
+}
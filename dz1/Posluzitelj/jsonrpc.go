@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net"
+)
+
+// Standard JSON-RPC 2.0 error codes. Codes from -32000 down to -32099 are
+// this server's own.
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeInternalError  = -32603
+	codeServerError    = -32000
+	codeRejected       = -32002
+	codeNotLeader      = -32003
+	codeUnauthorized   = -32004
+)
+
+// rpcError is a JSON-RPC error object. Methods may return one to pick the
+// code and data themselves.
+type rpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+type response struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	Id      json.RawMessage `json:"id"`
+}
+
+var nullId = json.RawMessage("null")
+
+func errorResponse(id json.RawMessage, e *rpcError) *response {
+	if id == nil {
+		id = nullId
+	}
+	return &response{Jsonrpc: "2.0", Error: e, Id: id}
+}
+
+type request struct {
+	Jsonrpc string                 `json:"jsonrpc"`
+	Method  string                 `json:"method"`
+	Params  map[string]interface{} `json:"params"`
+	// Id is a string, a number or null; a request without one is a
+	// notification and gets no response.
+	Id json.RawMessage `json:"id"`
+
+	resp *response
+}
+
+// toRPCError maps what a method returned to the error the client sees.
+func toRPCError(err error) *rpcError {
+	switch e := err.(type) {
+	case *rpcError:
+		return e
+	case *NotLeaderError:
+		return &rpcError{Code: codeNotLeader, Message: e.Error(), Data: map[string]string{"leader": e.Leader}}
+	case *ValidationError:
+		return &rpcError{Code: codeRejected, Message: e.Error(), Data: e}
+	default:
+		return &rpcError{Code: codeServerError, Message: "Server error " + err.Error()}
+	}
+}
+
+func (req *request) handleResponse(sol interface{}, err error) {
+	if err != nil {
+		req.resp = errorResponse(req.Id, toRPCError(err))
+		return
+	}
+	b, err := json.Marshal(sol)
+	if err != nil {
+		log.Println(err)
+		req.resp = errorResponse(req.Id, &rpcError{Code: codeInternalError, Message: "Internal error " + err.Error()})
+		return
+	}
+	req.resp = &response{Jsonrpc: "2.0", Result: b, Id: req.Id}
+}
+
+// parseRequest checks raw is a well formed request object, returning the
+// error response to send when it is not.
+func parseRequest(raw json.RawMessage) (*request, *response) {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, errorResponse(nil, &rpcError{Code: codeInvalidRequest, Message: "Invalid Request", Data: "request must be an object"})
+	}
+	id, hasId := fields["id"]
+	if hasId {
+		switch trimmed := bytes.TrimSpace(id); {
+		case bytes.Equal(trimmed, nullId):
+			id = nullId
+		case len(trimmed) > 0 && (trimmed[0] == '"' || trimmed[0] == '-' || trimmed[0] >= '0' && trimmed[0] <= '9'):
+			id = trimmed
+		default:
+			return nil, errorResponse(nil, &rpcError{Code: codeInvalidRequest, Message: "Invalid Request", Data: "id must be a string, a number or null"})
+		}
+	} else {
+		id = nil
+	}
+	req := &request{Id: id}
+	if err := json.Unmarshal(fields["jsonrpc"], &req.Jsonrpc); err != nil || req.Jsonrpc != "2.0" {
+		return nil, errorResponse(id, &rpcError{Code: codeInvalidRequest, Message: "Invalid Request", Data: `jsonrpc must be "2.0"`})
+	}
+	if err := json.Unmarshal(fields["method"], &req.Method); err != nil || req.Method == "" {
+		return nil, errorResponse(id, &rpcError{Code: codeInvalidRequest, Message: "Invalid Request", Data: "method must be a non-empty string"})
+	}
+	if params, ok := fields["params"]; ok && !bytes.Equal(bytes.TrimSpace(params), nullId) {
+		// numbers stay json.Numbers, a float64 would round a uint64 seq
+		decoder := json.NewDecoder(bytes.NewReader(params))
+		decoder.UseNumber()
+		if err := decoder.Decode(&req.Params); err != nil {
+			return nil, errorResponse(id, &rpcError{Code: codeInvalidParams, Message: "Invalid params", Data: "params must be an object"})
+		}
+	}
+	return req, nil
+}
+
+// Handler runs a call and returns its result.
+type Handler func(c *Call) (interface{}, error)
+
+// Middleware wraps every method's handler, outermost first.
+type Middleware func(next Handler) Handler
+
+// Method is a registered JSON-RPC method.
+type Method struct {
+	Name    string
+	Summary string
+	// Params makes the struct params are decoded into, nil when the method
+	// takes none or decodes them itself.
+	Params func() params
+	// Result is a value of the type the method returns, for rpc.discover.
+	Result interface{}
+	// Admin methods need the admin token. Internal ones are for the other
+	// servers only: they need the peer token and are left out of
+	// rpc.discover and the request log.
+	Admin, Internal bool
+	Handle          Handler
+}
+
+// Call is one method invocation making its way through the middleware.
+type Call struct {
+	Method  *Method
+	Request *request
+	Conn    net.Conn
+	Params  params // decoded just before Handle runs
+	after   []func()
+}
+
+// After schedules f to run once the response has been written.
+func (c *Call) After(f func()) {
+	c.after = append(c.after, f)
+}
+
+// Registry maps method names to their handlers.
+type Registry struct {
+	methods    map[string]*Method
+	names      []string // in registration order
+	middleware []Middleware
+	handler    Handler // invoke wrapped in middleware, only Use changes it
+}
+
+func NewRegistry() *Registry {
+	return &Registry{methods: make(map[string]*Method), handler: invoke}
+}
+
+func (r *Registry) Register(m *Method) {
+	if _, ok := r.methods[m.Name]; ok {
+		log.Panic("Method registered twice: ", m.Name)
+	}
+	r.methods[m.Name] = m
+	r.names = append(r.names, m.Name)
+}
+
+// Use adds middleware inside the middleware added before it. It must be
+// done before the registry answers any request.
+func (r *Registry) Use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+	r.handler = invoke
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		r.handler = r.middleware[i](r.handler)
+	}
+}
+
+// invoke decodes the params and runs the method itself.
+func invoke(c *Call) (interface{}, error) {
+	if c.Method.Params != nil {
+		p := c.Method.Params()
+		if err := c.Request.parseParams(p); err != nil {
+			return nil, err
+		}
+		c.Params = p
+	}
+	return c.Method.Handle(c)
+}
+
+// call runs one request, returning nil for notifications.
+func (r *Registry) call(raw json.RawMessage, conn net.Conn) (*response, []func()) {
+	req, errResp := parseRequest(raw)
+	if errResp != nil {
+		return errResp, nil
+	}
+	c := &Call{Method: r.methods[req.Method], Request: req, Conn: conn}
+	if c.Method == nil {
+		log.Println("Method not found:", req.Method)
+		req.handleResponse(nil, &rpcError{Code: codeMethodNotFound, Message: "Method not found", Data: req.Method})
+	} else {
+		req.handleResponse(r.handler(c))
+	}
+	if req.Id == nil {
+		return nil, c.after
+	}
+	return req.resp, c.after
+}
+
+// answer runs a single request or a batch, returning the response, nil if
+// there is none to send, and what to run once it is sent. conn is nil when
+// the request did not come over a connection that stays open.
+func (r *Registry) answer(line []byte, conn net.Conn) (sol interface{}, after []func()) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] == '[' {
+		batch := []json.RawMessage{}
+		if err := json.Unmarshal(line, &batch); err != nil {
+			sol = errorResponse(nil, &rpcError{Code: codeParseError, Message: "Parse error", Data: err.Error()})
+		} else if len(batch) == 0 {
+			sol = errorResponse(nil, &rpcError{Code: codeInvalidRequest, Message: "Invalid Request", Data: "empty batch"})
+		} else {
+			resps := []*response{}
+			for _, raw := range batch {
+				resp, a := r.call(raw, conn)
+				if resp != nil {
+					resps = append(resps, resp)
+				}
+				after = append(after, a...)
+			}
+			if len(resps) > 0 {
+				sol = resps
+			}
+		}
+	} else if !json.Valid(line) {
+		sol = errorResponse(nil, &rpcError{Code: codeParseError, Message: "Parse error"})
+	} else {
+		resp, a := r.call(line, conn)
+		if resp != nil {
+			sol = resp
+		}
+		after = a
+	}
+	return sol, after
+}
+
+// dispatch answers one line read from conn.
+func (r *Registry) dispatch(line []byte, conn net.Conn) error {
+	sol, after := r.answer(line, conn)
+	if sol != nil {
+		b, err := json.Marshal(sol)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	for _, f := range after {
+		go f()
+	}
+	return nil
+}
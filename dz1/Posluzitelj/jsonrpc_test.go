@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testRegistry() *Registry {
+	r := NewRegistry()
+	r.Register(&Method{
+		Name:   "ping",
+		Result: "",
+		Handle: func(c *Call) (interface{}, error) {
+			return "pong", nil
+		},
+	})
+	r.Register(&Method{
+		Name:   "echo",
+		Params: func() params { return &usernameParams{} },
+		Result: "",
+		Handle: func(c *Call) (interface{}, error) {
+			return c.Params.(*usernameParams).Username, nil
+		},
+	})
+	return r
+}
+
+// sameResponse compares what answer returned with want, both as JSON. An
+// error in want without data matches any data.
+func sameResponse(t *testing.T, got interface{}, want string) bool {
+	b, err := json.Marshal(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g, w interface{}
+	if err := json.Unmarshal(b, &g); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	ignoreData(g, w)
+	return reflect.DeepEqual(g, w)
+}
+
+func ignoreData(got, want interface{}) {
+	switch w := want.(type) {
+	case []interface{}:
+		if g, ok := got.([]interface{}); ok && len(g) == len(w) {
+			for i := range w {
+				ignoreData(g[i], w[i])
+			}
+		}
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return
+		}
+		wantErr, _ := w["error"].(map[string]interface{})
+		gotErr, _ := g["error"].(map[string]interface{})
+		if wantErr != nil && gotErr != nil {
+			if _, ok := wantErr["data"]; !ok {
+				delete(gotErr, "data")
+			}
+		}
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string // empty when nothing is sent back
+	}{
+		// single requests
+		{"result", `{"jsonrpc":"2.0","method":"ping","id":1}`,
+			`{"jsonrpc":"2.0","result":"pong","id":1}`},
+		{"params", `{"jsonrpc":"2.0","method":"echo","params":{"username":"u1"},"id":2}`,
+			`{"jsonrpc":"2.0","result":"u1","id":2}`},
+		{"null params", `{"jsonrpc":"2.0","method":"ping","params":null,"id":3}`,
+			`{"jsonrpc":"2.0","result":"pong","id":3}`},
+		{"blank line", "  \n", ""},
+
+		// ids come back as they were sent
+		{"string id", `{"jsonrpc":"2.0","method":"ping","id":"abc"}`,
+			`{"jsonrpc":"2.0","result":"pong","id":"abc"}`},
+		{"empty string id", `{"jsonrpc":"2.0","method":"ping","id":""}`,
+			`{"jsonrpc":"2.0","result":"pong","id":""}`},
+		{"negative id", `{"jsonrpc":"2.0","method":"ping","id":-7}`,
+			`{"jsonrpc":"2.0","result":"pong","id":-7}`},
+		{"fractional id", `{"jsonrpc":"2.0","method":"ping","id":1.5}`,
+			`{"jsonrpc":"2.0","result":"pong","id":1.5}`},
+		{"null id", `{"jsonrpc":"2.0","method":"ping","id":null}`,
+			`{"jsonrpc":"2.0","result":"pong","id":null}`},
+
+		// notifications
+		{"notification", `{"jsonrpc":"2.0","method":"ping"}`, ""},
+		{"failed notification", `{"jsonrpc":"2.0","method":"echo"}`, ""},
+		{"unknown notification", `{"jsonrpc":"2.0","method":"nope"}`, ""},
+
+		// batches
+		{"batch", `[{"jsonrpc":"2.0","method":"ping","id":1},{"jsonrpc":"2.0","method":"echo","params":{"username":"u2"},"id":"b"}]`,
+			`[{"jsonrpc":"2.0","result":"pong","id":1},{"jsonrpc":"2.0","result":"u2","id":"b"}]`},
+		{"batch with notification", `[{"jsonrpc":"2.0","method":"ping"},{"jsonrpc":"2.0","method":"ping","id":null}]`,
+			`[{"jsonrpc":"2.0","result":"pong","id":null}]`},
+		{"notification batch", `[{"jsonrpc":"2.0","method":"ping"},{"jsonrpc":"2.0","method":"nope"}]`, ""},
+		{"empty batch", `[]`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+		{"batch of non-requests", `[1,2]`,
+			`[{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null},{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}]`},
+		{"batch with bad request", `[{"jsonrpc":"2.0","method":"ping","id":1},{"method":"ping","id":2}]`,
+			`[{"jsonrpc":"2.0","result":"pong","id":1},{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":2}]`},
+
+		// -32700
+		{"parse error", `{"jsonrpc":"2.0","method":"ping","id":1`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`},
+		{"batch parse error", `[{"jsonrpc":"2.0","method":"ping","id":1},`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`},
+
+		// -32600
+		{"not an object", `"ping"`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+		{"wrong version", `{"jsonrpc":"1.0","method":"ping","id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request","data":"jsonrpc must be \"2.0\""},"id":1}`},
+		{"no version", `{"method":"ping","id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":1}`},
+		{"no method", `{"jsonrpc":"2.0","id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request","data":"method must be a non-empty string"},"id":1}`},
+		{"method not a string", `{"jsonrpc":"2.0","method":1,"id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":1}`},
+		{"object id", `{"jsonrpc":"2.0","method":"ping","id":{}}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request","data":"id must be a string, a number or null"},"id":null}`},
+		{"bool id", `{"jsonrpc":"2.0","method":"ping","id":true}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+
+		// -32601
+		{"unknown method", `{"jsonrpc":"2.0","method":"nope","id":7}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found","data":"nope"},"id":7}`},
+
+		// -32602
+		{"missing param", `{"jsonrpc":"2.0","method":"echo","params":{},"id":8}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params","data":[{"field":"username","message":"required"}]},"id":8}`},
+		{"mistyped param", `{"jsonrpc":"2.0","method":"echo","params":{"username":5},"id":9}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params"},"id":9}`},
+		{"params not an object", `{"jsonrpc":"2.0","method":"echo","params":["u1"],"id":10}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params","data":"params must be an object"},"id":10}`},
+	}
+	r := testRegistry()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sol, _ := r.answer([]byte(test.line), nil)
+			if test.want == "" {
+				if sol != nil {
+					b, _ := json.Marshal(sol)
+					t.Errorf("answer(%s) = %s, want no response", test.line, b)
+				}
+				return
+			}
+			if !sameResponse(t, sol, test.want) {
+				b, _ := json.Marshal(sol)
+				t.Errorf("answer(%s) = %s, want %s", test.line, b, test.want)
+			}
+		})
+	}
+}
+
+// TestIdsVerbatim checks ids are echoed byte for byte, so numbers too big
+// for a float64 survive.
+func TestIdsVerbatim(t *testing.T) {
+	r := testRegistry()
+	for _, id := range []string{`12345678901234567890123`, `1e400`, `"é"`, `-0`} {
+		sol, _ := r.answer([]byte(`{"jsonrpc":"2.0","method":"ping","id":`+id+`}`), nil)
+		resp, ok := sol.(*response)
+		if !ok {
+			t.Fatalf("id %s: got %#v", id, sol)
+		}
+		if string(resp.Id) != id {
+			t.Errorf("id %s came back as %s", id, resp.Id)
+		}
+	}
+}
+
+type seqParams struct {
+	Seq uint64 `json:"seq"`
+}
+
+func (p *seqParams) check(errs *paramErrors) {}
+
+// TestParamsExact checks numbers reach the params struct as they were sent,
+// not rounded to a float64 on the way.
+func TestParamsExact(t *testing.T) {
+	for _, seq := range []uint64{0, 1 << 53, 1<<53 + 1, 18446744073709551615} {
+		req, resp := parseRequest([]byte(fmt.Sprintf(`{"jsonrpc":"2.0","method":"ping","params":{"seq":%d},"id":1}`, seq)))
+		if resp != nil {
+			t.Fatalf("seq %d: %#v", seq, resp.Error)
+		}
+		p := &seqParams{}
+		if err := req.parseParams(p); err != nil {
+			t.Fatalf("seq %d: %s", seq, err)
+		}
+		if p.Seq != seq {
+			t.Errorf("seq %d came through as %d", seq, p.Seq)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Signature"
+)
+
+// leaseTTL is how long a sensor stays registered after registering, its
+// last heartbeat or its last stored measurement; 0 keeps sensors forever.
+var leaseTTL time.Duration
+
+// maxClockSkew bounds how far the time a sensor signed a heartbeat or
+// unregister at may be from the server's clock.
+const maxClockSkew = time.Minute
+
+// Lease is what a heartbeat returns.
+type Lease struct {
+	Username string     `json:"username"`
+	Expires  *time.Time `json:"expires"` // nil when leases are off
+}
+
+func leaseExpiry(now time.Time) time.Time {
+	if leaseTTL == 0 {
+		return time.Time{}
+	}
+	return now.Add(leaseTTL)
+}
+
+// sensor returns the registered sensor username, nil if there is none or
+// its lease ran out. Needs state.mutex.
+func (state *SensorState) sensor(username string, now time.Time) *Vertex {
+	v, ok := state.sensors[username]
+	if !ok || v.expired(now) {
+		return nil
+	}
+	return v
+}
+
+// checkSigned checks signed is true of username's key and that at, the time
+// the sensor signed at, is recent, not before it registered and after the
+// last request it signed, which at then becomes.
+func (state *SensorState) checkSigned(username string, at time.Time, signed func(key ed25519.PublicKey) bool) error {
+	now := time.Now()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	sensor := state.sensor(username, now)
+	if sensor == nil {
+		return errors.New(fmt.Sprintf("Cannot found %s in sensors list", username))
+	}
+	if skew := now.Sub(at); skew > maxClockSkew || skew < -maxClockSkew {
+		return errors.New(fmt.Sprintf("Time %s is too far from the server's %s", at.Format(time.RFC3339Nano), now.Format(time.RFC3339Nano)))
+	}
+	if at.Before(sensor.registered.Add(-maxClockSkew)) {
+		return errors.New(fmt.Sprint("Time is before ", username, " registered"))
+	}
+	if last, ok := state.signedAt[username]; ok && !at.After(last) {
+		return errors.New(fmt.Sprintf("Time %s is not after %s, when %s last signed a request", at.Format(time.RFC3339Nano), last.Format(time.RFC3339Nano), username))
+	}
+	if !signed(sensor.PublicKey) {
+		return errors.New("Invalid signature")
+	}
+	state.signedAt[username] = at
+	return nil
+}
+
+// signed records that username signed a request at time at, so that every
+// server knows what the next one has to come after.
+func (state *SensorState) signed(username string, at time.Time) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if at.After(state.signedAt[username]) {
+		state.signedAt[username] = at
+	}
+}
+
+func (state *SensorState) checkLease(op, username string, at time.Time, sig []byte) error {
+	return state.checkSigned(username, at, func(key ed25519.PublicKey) bool {
+		return Signature.VerifyLease(key, sig, op, username, at)
+	})
+}
+
+// heartbeat renews username's lease.
+func (state *SensorState) heartbeat(username string, at time.Time, sig []byte) (*Lease, error) {
+	if err := state.checkLease("heartbeat", username, at, sig); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sol, err := state.submit(command{Op: "heartbeat", Username: username, At: at, Time: now, Expires: leaseExpiry(now)})
+	if err != nil {
+		return nil, err
+	}
+	return sol.(*Lease), nil
+}
+
+// unregister drops username from the sensors list.
+func (state *SensorState) unregister(username string, at time.Time, sig []byte) (bool, error) {
+	if err := state.checkLease("unregister", username, at, sig); err != nil {
+		return false, err
+	}
+	sol, err := state.submit(command{Op: "unregister", Username: username, At: at, Time: time.Now()})
+	if err != nil {
+		return false, err
+	}
+	return sol.(bool), nil
+}
+
+// renewLease moves username's lease to expires, unless it already ran out
+// at time at.
+func (state *SensorState) renewLease(username string, at, expires time.Time) *Lease {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	sol := &Lease{Username: username}
+	if v := state.sensor(username, at); v != nil {
+		v.expires = expires
+		if !expires.IsZero() {
+			sol.Expires = &expires
+		}
+	}
+	return sol
+}
+
+func (state *SensorState) removeSensor(username string, at time.Time) bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	v, ok := state.sensors[username]
+	if ok {
+		delete(state.sensors, username)
+		state.index.Remove(username)
+		state.audit(v, "unregister", at, nil)
+	}
+	return ok
+}
+
+// evict drops every sensor whose lease ran out by now, returning how many.
+func (state *SensorState) evict(now time.Time) int {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	sol := 0
+	for username, v := range state.sensors {
+		if v.expired(now) {
+			log.Println("Lease of", username, "expired")
+			delete(state.sensors, username)
+			state.index.Remove(username)
+			state.audit(v, "expire", now, nil)
+			sol++
+		}
+	}
+	return sol
+}
+
+// expireLeases periodically evicts the sensors whose leases ran out. With
+// replication only the leader gets to.
+func (state *SensorState) expireLeases() {
+	for range time.Tick(leaseTTL / 2) {
+		now := time.Now()
+		state.mutex.Lock()
+		expired := false
+		for _, v := range state.sensors {
+			expired = expired || v.expired(now)
+		}
+		state.mutex.Unlock()
+		if !expired {
+			continue
+		}
+		if _, err := state.submit(command{Op: "expire", Time: now}); err != nil {
+			if _, ok := err.(*NotLeaderError); !ok {
+				log.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"log"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+)
+
+func records(blks []*Block) []Chain.Record {
+	sol := make([]Chain.Record, len(blks))
+	for i, blk := range blks {
+		sol[i] = blk.record()
+	}
+	return sol
+}
+
+// registerMethods registers every method the server answers.
+func registerMethods(r *Registry, state *SensorState) {
+	r.Register(&Method{
+		Name:    "test",
+		Summary: "Echoes the username back",
+		Params:  func() params { return &usernameParams{} },
+		Result:  "",
+		Handle: func(c *Call) (interface{}, error) {
+			return state.test(c.Params.(*usernameParams).Username)
+		},
+	})
+	r.Register(&Method{
+		Name:    "register",
+		Summary: "Registers a sensor with its location, address and public key, returning its lease and the last sequence number stored for it",
+		Params:  func() params { return &registerParams{} },
+		Result:  &Registration{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*registerParams)
+			return state.register(p.Username, *p.Lat, *p.Lon, p.Ip, *p.Port, p.key, p.Params)
+		},
+	})
+	r.Register(&Method{
+		Name:    "search",
+		Summary: "Finds the nearest sensor that measures params; when none does, fallback picks the nearest (\"nearest\"), the one measuring most of them (\"most\") or null (\"none\")",
+		Params:  func() params { return &searchParams{} },
+		Result:  &Vertex{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*searchParams)
+			sol, err := state.search(p.Username, p.Params, p.Fallback)
+			if sol != nil {
+				log.Println(*sol)
+			}
+			return sol, err
+		},
+	})
+	r.Register(&Method{
+		Name:    "getSensors",
+		Summary: "Returns the registered sensors by username",
+		Result:  []*Vertex{},
+		Handle: func(c *Call) (interface{}, error) {
+			return state.listSensors(), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "searchK",
+		Summary: "Finds the k sensors nearest to the given one, nearest first",
+		Params:  func() params { return &searchKParams{} },
+		Result:  []Neighbour{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*searchKParams)
+			return state.searchK(p.Username, *p.K)
+		},
+	})
+	r.Register(&Method{
+		Name:    "searchRadius",
+		Summary: "Finds the sensors within km of a location, nearest first",
+		Params:  func() params { return &searchRadiusParams{} },
+		Result:  []Neighbour{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*searchRadiusParams)
+			return state.searchRadius(*p.Lat, *p.Lon, *p.Km), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "update",
+		Summary: "Moves the sensor or changes its address, params or metadata; signed over every other param",
+		Params:  func() params { return &updateParams{} },
+		Result:  &Vertex{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*updateParams)
+			return state.update(p.Username, p.at, p.sig, c.Request.Params, &p.SensorUpdate)
+		},
+	})
+	r.Register(&Method{
+		Name:    "getSensorHistory",
+		Summary: "Returns when the sensor registered, changed and left, oldest first",
+		Params:  func() params { return &usernameParams{} },
+		Result:  []SensorChange{},
+		Handle: func(c *Call) (interface{}, error) {
+			return state.getHistory(c.Params.(*usernameParams).Username), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "heartbeat",
+		Summary: "Renews the sensor's lease, signed over (\"heartbeat\", username, at)",
+		Params:  func() params { return &leaseParams{} },
+		Result:  &Lease{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*leaseParams)
+			return state.heartbeat(p.Username, p.at, p.sig)
+		},
+	})
+	r.Register(&Method{
+		Name:    "unregister",
+		Summary: "Removes the sensor, signed over (\"unregister\", username, at)",
+		Params:  func() params { return &leaseParams{} },
+		Result:  true,
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*leaseParams)
+			return state.unregister(p.Username, p.at, p.sig)
+		},
+	})
+	r.Register(&Method{
+		Name:    "storeMeasurement",
+		Summary: "Stores one measurement, signed over (username, param, averageValue, measuredAt, seq), in a new block",
+		Params:  func() params { return &storeMeasurementParams{} },
+		Result:  &Receipt{},
+		Handle: func(c *Call) (interface{}, error) {
+			m := c.Params.(*storeMeasurementParams).measurement
+			return state.storeMeasurement(m.Username, m.Param, m.Value, m.Measured, m.Seq, m.Sig)
+		},
+	})
+	r.Register(&Method{
+		Name:    "storeMeasurements",
+		Summary: "Stores a batch of measurements from one sensor, each signed as storeMeasurement's, in a new block",
+		Params:  func() params { return &storeMeasurementsParams{} },
+		Result:  &Receipt{},
+		Handle: func(c *Call) (interface{}, error) {
+			return state.storeMeasurements(c.Params.(*storeMeasurementsParams).measurements)
+		},
+	})
+	r.Register(&Method{
+		Name:    "importBlocks",
+		Summary: "Appends exported blocks after the tip and returns the new tip",
+		Params:  func() params { return &importBlocksParams{} },
+		Result:  Chain.Record{},
+		Admin:   true,
+		Handle: func(c *Call) (interface{}, error) {
+			sol, err := state.submit(command{Op: "import", Blocks: c.Params.(*importBlocksParams).Blocks})
+			if err != nil {
+				return nil, err
+			}
+			return sol.(*Block).record(), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "subscribeBlocks",
+		Summary: "Pushes every new block, optionally only those with a username or param, as block notifications",
+		Params:  func() params { return &subscribeParams{} },
+		Result:  0,
+		Handle: func(c *Call) (interface{}, error) {
+			if c.Conn == nil {
+				return nil, errors.New("Subscribing needs a TCP connection to push blocks over")
+			}
+			p := c.Params.(*subscribeParams)
+			sub := subscribe(c.Conn, "block", p.Username, p.Param)
+			c.After(sub.send)
+			return sub.id, nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "subscribeSensors",
+		Summary: "Pushes sensors registering, changing and leaving, optionally only username, as sensor notifications",
+		Params:  func() params { return &subscribeSensorsParams{} },
+		Result:  0,
+		Handle: func(c *Call) (interface{}, error) {
+			if c.Conn == nil {
+				return nil, errors.New("Subscribing needs a TCP connection to push sensors over")
+			}
+			sub := subscribe(c.Conn, "sensor", c.Params.(*subscribeSensorsParams).Username, "")
+			c.After(sub.send)
+			return sub.id, nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "unsubscribe",
+		Summary: "Cancels a subscription made over the same connection",
+		Params:  func() params { return &unsubscribeParams{} },
+		Result:  true,
+		Handle: func(c *Call) (interface{}, error) {
+			return unsubscribe(c.Conn, *c.Params.(*unsubscribeParams).Subscription), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "getReceipt",
+		Summary: "Checks that block id still has the given hash",
+		Params:  func() params { return &receiptParams{} },
+		Result:  &Receipt{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*receiptParams)
+			return GetReceipt(*p.Id, p.Hash)
+		},
+	})
+	r.Register(&Method{
+		Name:    "getProof",
+		Summary: "Returns a Merkle inclusion proof for a measurement in block id",
+		Params:  func() params { return &proofParams{} },
+		Result:  &MerkleProof{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*proofParams)
+			return GetProof(*p.Id, p.Username, *p.Seq)
+		},
+	})
+	r.Register(&Method{
+		Name:    "getState",
+		Summary: "Returns the newest value of every param of every sensor",
+		Result:  map[string]map[string]float64{},
+		Handle: func(c *Call) (interface{}, error) {
+			return GetState(), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "getStateAt",
+		Summary: "Returns the state right after block id, or as it was at a time",
+		Params:  func() params { return &stateAtParams{} },
+		Result:  map[string]map[string]float64{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*stateAtParams)
+			if p.Id == nil {
+				return GetStateAtTime(p.at)
+			}
+			return GetStateAt(*p.Id)
+		},
+	})
+	r.Register(&Method{
+		Name:    "getBlock",
+		Summary: "Returns block id",
+		Params:  func() params { return &blockIdParams{} },
+		Result:  Chain.Record{},
+		Handle: func(c *Call) (interface{}, error) {
+			blk, err := GetBlock(*c.Params.(*blockIdParams).Id)
+			if err != nil {
+				return nil, err
+			}
+			return blk.record(), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "getBlocks",
+		Summary: "Returns blocks from..to, at most limit of them",
+		Params:  func() params { return &blocksParams{} },
+		Result:  []Chain.Record{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*blocksParams)
+			blks, err := GetBlocks(*p.From, p.to, p.limit)
+			return records(blks), err
+		},
+	})
+	r.Register(&Method{
+		Name:    "getBlocksByTime",
+		Summary: "Returns blocks received between from and to, at most limit of them",
+		Params:  func() params { return &blocksByTimeParams{} },
+		Result:  []Chain.Record{},
+		Handle: func(c *Call) (interface{}, error) {
+			p := c.Params.(*blocksByTimeParams)
+			blks, err := GetBlocksByTime(p.from, p.to, p.limit)
+			return records(blks), err
+		},
+	})
+	r.Register(&Method{
+		Name:    "getMiningStats",
+		Summary: "Returns how long mining took, per difficulty",
+		Result:  []MiningStats{},
+		Handle: func(c *Call) (interface{}, error) {
+			return GetMiningStats(), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "verifyChain",
+		Summary: "Re-hashes the whole chain and reports the first bad block",
+		Result:  Chain.Report{},
+		Handle: func(c *Call) (interface{}, error) {
+			return VerifyChain(), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "getServerKey",
+		Summary: "Returns the hex public key checkpoint blocks are signed with",
+		Result:  "",
+		Handle: func(c *Call) (interface{}, error) {
+			return hex.EncodeToString(serverKey.Public().(ed25519.PublicKey)), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "rpc.metrics",
+		Summary: "Returns how often and how long every method ran",
+		Result:  []MethodMetrics{},
+		Handle: func(c *Call) (interface{}, error) {
+			return GetMethodMetrics(), nil
+		},
+	})
+	r.Register(&Method{
+		Name:    "rpc.discover",
+		Summary: "Returns the OpenRPC description of this server",
+		Result:  map[string]interface{}{},
+		Handle: func(c *Call) (interface{}, error) {
+			return r.Discover(), nil
+		},
+	})
+	r.Register(&Method{
+		Name:     "raft.requestVote",
+		Internal: true,
+		Result:   voteReply{},
+		Handle: func(c *Call) (interface{}, error) {
+			args := voteArgs{}
+			if err := state.raftParams(c.Request.Params, &args); err != nil {
+				return nil, err
+			}
+			return state.raft.RequestVote(args), nil
+		},
+	})
+	r.Register(&Method{
+		Name:     "raft.appendEntries",
+		Internal: true,
+		Result:   appendReply{},
+		Handle: func(c *Call) (interface{}, error) {
+			args := appendArgs{}
+			if err := state.raftParams(c.Request.Params, &args); err != nil {
+				return nil, err
+			}
+			return state.raft.AppendEntries(args), nil
+		},
+	})
+	r.Register(&Method{
+		Name:     "raft.installSnapshot",
+		Internal: true,
+		Result:   appendReply{},
+		Handle: func(c *Call) (interface{}, error) {
+			args := snapshotArgs{}
+			if err := state.raftParams(c.Request.Params, &args); err != nil {
+				return nil, err
+			}
+			return state.raft.InstallSnapshot(args), nil
+		},
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recoverPanics turns a panicking method into an internal error instead of
+// dropping the connection.
+func recoverPanics(next Handler) Handler {
+	return func(c *Call) (sol interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("%s: %s", r, debug.Stack())
+				sol, err = nil, &rpcError{Code: codeInternalError, Message: "Internal error", Data: fmt.Sprint(r)}
+			}
+		}()
+		return next(c)
+	}
+}
+
+// logCalls logs every request but the internal ones, and the failures. The
+// admin token is kept out of the log.
+func logCalls(next Handler) Handler {
+	return func(c *Call) (interface{}, error) {
+		if !c.Method.Internal {
+			params := c.Request.Params
+			if _, ok := params["auth"]; ok {
+				params = make(map[string]interface{}, len(c.Request.Params))
+				for k, v := range c.Request.Params {
+					params[k] = v
+				}
+				params["auth"] = "..."
+			}
+			log.Print("got: ", c.Request.Method, " ", params)
+		}
+		sol, err := next(c)
+		if err != nil && !c.Method.Internal {
+			log.Println(c.Request.Method, "failed:", err)
+		}
+		return sol, err
+	}
+}
+
+// requireAdmin rejects Admin methods unless params carry the token; without
+// one they are always refused.
+func requireAdmin(token string) Middleware {
+	return func(next Handler) Handler {
+		return func(c *Call) (interface{}, error) {
+			if c.Method.Admin && (token == "" || !hasToken(c.Request.Params, token)) {
+				return nil, &rpcError{Code: codeUnauthorized, Message: "Unauthorized", Data: c.Request.Method}
+			}
+			return next(c)
+		}
+	}
+}
+
+// requirePeer rejects Internal methods unless params carry the token the
+// servers replicating together share; without one they are always refused.
+func requirePeer(token string) Middleware {
+	return func(next Handler) Handler {
+		return func(c *Call) (interface{}, error) {
+			if c.Method.Internal && (token == "" || !hasToken(c.Request.Params, token)) {
+				return nil, &rpcError{Code: codeUnauthorized, Message: "Unauthorized", Data: c.Request.Method}
+			}
+			return next(c)
+		}
+	}
+}
+
+// hasToken reports whether params carry token as auth.
+func hasToken(params map[string]interface{}, token string) bool {
+	auth, _ := params["auth"].(string)
+	return subtle.ConstantTimeCompare([]byte(auth), []byte(token)) == 1
+}
+
+type MethodMetrics struct {
+	Method         string  `json:"method"`
+	Calls          int     `json:"calls"`
+	Errors         int     `json:"errors"`
+	TotalSeconds   float64 `json:"totalSeconds"`
+	AverageSeconds float64 `json:"averageSeconds"`
+	MaxSeconds     float64 `json:"maxSeconds"`
+}
+
+var methodMetrics = make(map[string]*MethodMetrics)
+var metricsMutex sync.Mutex
+
+// countCalls records how often and how long every method ran.
+func countCalls(next Handler) Handler {
+	return func(c *Call) (interface{}, error) {
+		start := time.Now()
+		sol, err := next(c)
+		took := time.Since(start).Seconds()
+
+		metricsMutex.Lock()
+		defer metricsMutex.Unlock()
+		stats, ok := methodMetrics[c.Method.Name]
+		if !ok {
+			stats = &MethodMetrics{Method: c.Method.Name}
+			methodMetrics[c.Method.Name] = stats
+		}
+		stats.Calls++
+		if err != nil {
+			stats.Errors++
+		}
+		stats.TotalSeconds += took
+		stats.AverageSeconds = stats.TotalSeconds / float64(stats.Calls)
+		if took > stats.MaxSeconds {
+			stats.MaxSeconds = took
+		}
+		return sol, err
+	}
+}
+
+// GetMethodMetrics returns the call statistics of every method called so far.
+func GetMethodMetrics() []MethodMetrics {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	sol := make([]MethodMetrics, 0, len(methodMetrics))
+	for _, stats := range methodMetrics {
+		sol = append(sol, *stats)
+	}
+	sort.Slice(sol, func(i, j int) bool { return sol[i].Method < sol[j].Method })
+	return sol
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// schema describes t as JSON Schema the way encoding/json would encode it.
+// seen guards against recursive types.
+func schema(t reflect.Type, seen map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.PtrTo(t).Implements(textMarshaler):
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": schema(t.Elem(), seen)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schema(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		properties := map[string]interface{}{}
+		for _, f := range fields(t) {
+			properties[f.name] = schema(f.Type, seen)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	return map[string]interface{}{}
+}
+
+type jsonField struct {
+	reflect.StructField
+	name string
+}
+
+// fields lists the fields encoding/json would encode, with those of embedded
+// structs pulled up.
+func fields(t reflect.Type) []jsonField {
+	sol := []jsonField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		if ft := f.Type; f.Anonymous && tag == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				sol = append(sol, fields(ft)...)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		sol = append(sol, jsonField{f, name})
+	}
+	return sol
+}
+
+// requiredParams lists the params check reports missing when none are given.
+func requiredParams(m *Method) map[string]bool {
+	errs := paramErrors{}
+	m.Params().check(&errs)
+	sol := map[string]bool{}
+	for _, e := range errs {
+		if e.Message == "required" {
+			sol[e.Field] = true
+		}
+	}
+	return sol
+}
+
+// Discover describes the registered methods as an OpenRPC document,
+// leaving out the internal ones.
+func (r *Registry) Discover() map[string]interface{} {
+	methods := []interface{}{}
+	for _, name := range r.names {
+		m := r.methods[name]
+		if m.Internal {
+			continue
+		}
+		params := []interface{}{}
+		if m.Params != nil {
+			need := requiredParams(m)
+			for _, f := range fields(reflect.TypeOf(m.Params()).Elem()) {
+				params = append(params, map[string]interface{}{
+					"name":     f.name,
+					"required": need[f.name],
+					"schema":   schema(f.Type, map[reflect.Type]bool{}),
+				})
+			}
+		}
+		if m.Admin {
+			params = append(params, map[string]interface{}{
+				"name":     "auth",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		result := map[string]interface{}{"name": "result", "schema": map[string]interface{}{}}
+		if m.Result != nil {
+			result["schema"] = schema(reflect.TypeOf(m.Result), map[reflect.Type]bool{})
+		}
+		methods = append(methods, map[string]interface{}{
+			"name":           m.Name,
+			"summary":        m.Summary,
+			"paramStructure": "by-name",
+			"params":         params,
+			"result":         result,
+		})
+	}
+	return map[string]interface{}{
+		"openrpc": "1.2.6",
+		"info": map[string]interface{}{
+			"title":   "Posluzitelj",
+			"version": "1.0.0",
+		},
+		"methods": methods,
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+)
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// paramErrors collects everything wrong with a request's params.
+type paramErrors []fieldError
+
+func (errs *paramErrors) add(field, format string, args ...interface{}) {
+	*errs = append(*errs, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// params is a method's params struct; check reports the fields that are
+// missing or out of range and fills in whatever is derived from them.
+type params interface {
+	check(errs *paramErrors)
+}
+
+// parseParams decodes req.Params into v and checks it, failing with -32602
+// and the offending fields.
+func (req *request) parseParams(v params) error {
+	errs := paramErrors{}
+	if err := decodeParams(req.Params, v); err != nil {
+		if te, ok := err.(*json.UnmarshalTypeError); ok {
+			errs.add(te.Field, "expected %s, got %s", te.Type, te.Value)
+		} else {
+			errs.add("", "%s", err)
+		}
+	} else {
+		v.check(&errs)
+	}
+	if len(errs) > 0 {
+		return &rpcError{Code: codeInvalidParams, Message: "Invalid params", Data: errs}
+	}
+	return nil
+}
+
+func (errs *paramErrors) required(field string, present bool) bool {
+	if !present {
+		errs.add(field, "required")
+	}
+	return present
+}
+
+func (errs *paramErrors) timestamp(field, value string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		errs.add(field, "expected an RFC 3339 time, got %q", value)
+	}
+	return t
+}
+
+func (errs *paramErrors) base64(field, value string) []byte {
+	sol, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		errs.add(field, "expected base64")
+		return nil
+	}
+	return sol
+}
+
+func (errs *paramErrors) location(lat, lon *float64) {
+	if errs.required("lat", lat != nil) && (*lat < -90 || *lat > 90) {
+		errs.add("lat", "%v is not between -90 and 90", *lat)
+	}
+	if errs.required("lon", lon != nil) && (*lon < -180 || *lon > 180) {
+		errs.add("lon", "%v is not between -180 and 180", *lon)
+	}
+}
+
+type usernameParams struct {
+	Username string `json:"username"`
+}
+
+func (p *usernameParams) check(errs *paramErrors) {
+	errs.required("username", p.Username != "")
+}
+
+type searchKParams struct {
+	Username string `json:"username"`
+	K        *int   `json:"k"`
+}
+
+func (p *searchKParams) check(errs *paramErrors) {
+	errs.required("username", p.Username != "")
+	if errs.required("k", p.K != nil) && *p.K < 1 {
+		errs.add("k", "%d is not positive", *p.K)
+	}
+}
+
+type searchRadiusParams struct {
+	Lat *float64 `json:"lat"`
+	Lon *float64 `json:"lon"`
+	Km  *float64 `json:"km"`
+}
+
+func (p *searchRadiusParams) check(errs *paramErrors) {
+	errs.location(p.Lat, p.Lon)
+	if errs.required("km", p.Km != nil) && (*p.Km < 0 || math.IsNaN(*p.Km)) {
+		errs.add("km", "%v is not a distance", *p.Km)
+	}
+}
+
+type registerParams struct {
+	Username  string   `json:"username"`
+	Lat       *float64 `json:"lat"`
+	Lon       *float64 `json:"lon"`
+	Ip        string   `json:"ip"`
+	Port      *int     `json:"port"`
+	PublicKey string   `json:"publicKey"`
+	Params    []string `json:"params"` // what the sensor measures, optional
+	key       []byte
+}
+
+func (p *registerParams) check(errs *paramErrors) {
+	errs.required("username", p.Username != "")
+	errs.location(p.Lat, p.Lon)
+	if errs.required("ip", p.Ip != "") && net.ParseIP(p.Ip) == nil {
+		errs.add("ip", "%q is not an IP address", p.Ip)
+	}
+	if errs.required("port", p.Port != nil) && (*p.Port < 1 || *p.Port > 65535) {
+		errs.add("port", "%d is not between 1 and 65535", *p.Port)
+	}
+	if errs.required("publicKey", p.PublicKey != "") {
+		p.key = errs.base64("publicKey", p.PublicKey)
+		if p.key != nil && len(p.key) != ed25519.PublicKeySize {
+			errs.add("publicKey", "expected %d bytes, got %d", ed25519.PublicKeySize, len(p.key))
+		}
+	}
+	errs.names("params", p.Params)
+}
+
+// names checks a list of param names has no empty ones.
+func (errs *paramErrors) names(field string, names []string) {
+	for i, name := range names {
+		if name == "" {
+			errs.add(fmt.Sprintf("%s[%d]", field, i), "empty param name")
+		}
+	}
+}
+
+// searchParams asks for the sensor nearest to Username that measures all
+// of Params, falling back as Fallback says when none does.
+type searchParams struct {
+	Username string   `json:"username"`
+	Params   []string `json:"params"`
+	Fallback string   `json:"fallback"`
+}
+
+func (p *searchParams) check(errs *paramErrors) {
+	errs.required("username", p.Username != "")
+	errs.names("params", p.Params)
+	switch p.Fallback {
+	case "":
+		p.Fallback = fallbackNearest
+	case fallbackNearest, fallbackMost, fallbackNone:
+	default:
+		errs.add("fallback", "expected %q, %q or %q, got %q", fallbackNearest, fallbackMost, fallbackNone, p.Fallback)
+	}
+}
+
+// leaseParams is a heartbeat or unregister signed by the sensor at At.
+type leaseParams struct {
+	Username  string `json:"username"`
+	At        string `json:"at"`
+	Signature string `json:"signature"`
+	at        time.Time
+	sig       []byte
+}
+
+func (p *leaseParams) check(errs *paramErrors) {
+	errs.required("username", p.Username != "")
+	if errs.required("at", p.At != "") {
+		p.at = errs.timestamp("at", p.At)
+	}
+	if errs.required("signature", p.Signature != "") {
+		p.sig = errs.base64("signature", p.Signature)
+	}
+}
+
+// updateParams is a SensorUpdate signed by the sensor at At, over all the
+// params but the signature.
+type updateParams struct {
+	SensorUpdate
+	Username  string `json:"username"`
+	At        string `json:"at"`
+	Signature string `json:"signature"`
+	at        time.Time
+	sig       []byte
+}
+
+func (p *updateParams) check(errs *paramErrors) {
+	errs.required("username", p.Username != "")
+	if errs.required("at", p.At != "") {
+		p.at = errs.timestamp("at", p.At)
+	}
+	if errs.required("signature", p.Signature != "") {
+		p.sig = errs.base64("signature", p.Signature)
+	}
+	u := &p.SensorUpdate
+	if u.Lat == nil && u.Lon == nil && u.Ip == "" && u.Port == nil && u.Params == nil &&
+		u.Owner == nil && u.Model == nil && u.Firmware == nil && len(u.Units) == 0 {
+		errs.add("", "nothing to update")
+	}
+	if u.Lat != nil && (*u.Lat < -90 || *u.Lat > 90) {
+		errs.add("lat", "%v is not between -90 and 90", *u.Lat)
+	}
+	if u.Lon != nil && (*u.Lon < -180 || *u.Lon > 180) {
+		errs.add("lon", "%v is not between -180 and 180", *u.Lon)
+	}
+	if u.Ip != "" && net.ParseIP(u.Ip) == nil {
+		errs.add("ip", "%q is not an IP address", u.Ip)
+	}
+	if u.Port != nil && (*u.Port < 1 || *u.Port > 65535) {
+		errs.add("port", "%d is not between 1 and 65535", *u.Port)
+	}
+	if u.Params != nil {
+		errs.required("params", len(u.Params) > 0)
+		errs.names("params", u.Params)
+	}
+	for param := range u.Units {
+		if param == "" {
+			errs.add("units", "empty param name")
+		}
+	}
+}
+
+type storeMeasurementParams struct {
+	Username     string   `json:"username"`
+	Param        string   `json:"param"`
+	AverageValue *float64 `json:"averageValue"`
+	MeasuredAt   string   `json:"measuredAt"`
+	Seq          *uint64  `json:"seq"`
+	Signature    string   `json:"signature"`
+	measurement  Measurement
+}
+
+func (p *storeMeasurementParams) check(errs *paramErrors) {
+	errs.required("username", p.Username != "")
+	errs.required("param", p.Param != "")
+	errs.required("averageValue", p.AverageValue != nil)
+	errs.required("seq", p.Seq != nil)
+	p.measurement = Measurement{Username: p.Username, Param: p.Param}
+	if p.AverageValue != nil {
+		p.measurement.Value = *p.AverageValue
+	}
+	if p.Seq != nil {
+		p.measurement.Seq = *p.Seq
+	}
+	if p.MeasuredAt != "" {
+		p.measurement.Measured = errs.timestamp("measuredAt", p.MeasuredAt)
+	}
+	if errs.required("signature", p.Signature != "") {
+		p.measurement.Sig = errs.base64("signature", p.Signature)
+	}
+}
+
+type storeMeasurementsParams struct {
+	Username     string `json:"username"`
+	MeasuredAt   string `json:"measuredAt"`
+	Measurements []struct {
+		Param        string   `json:"param"`
+		AverageValue *float64 `json:"averageValue"`
+		Seq          *uint64  `json:"seq"`
+		Signature    string   `json:"signature"`
+	} `json:"measurements"`
+	measurements []Measurement
+}
+
+func (p *storeMeasurementsParams) check(errs *paramErrors) {
+	errs.required("username", p.Username != "")
+	var measured time.Time
+	if p.MeasuredAt != "" {
+		measured = errs.timestamp("measuredAt", p.MeasuredAt)
+	}
+	errs.required("measurements", len(p.Measurements) > 0)
+	for i, m := range p.Measurements {
+		field := fmt.Sprintf("measurements[%d].", i)
+		errs.required(field+"param", m.Param != "")
+		errs.required(field+"averageValue", m.AverageValue != nil)
+		errs.required(field+"seq", m.Seq != nil)
+		sol := Measurement{Username: p.Username, Param: m.Param, Measured: measured}
+		if m.AverageValue != nil {
+			sol.Value = *m.AverageValue
+		}
+		if m.Seq != nil {
+			sol.Seq = *m.Seq
+		}
+		if errs.required(field+"signature", m.Signature != "") {
+			sol.Sig = errs.base64(field+"signature", m.Signature)
+		}
+		p.measurements = append(p.measurements, sol)
+	}
+}
+
+type importBlocksParams struct {
+	Blocks []Chain.Record `json:"blocks"`
+}
+
+func (p *importBlocksParams) check(errs *paramErrors) {
+	errs.required("blocks", len(p.Blocks) > 0)
+}
+
+type subscribeParams struct {
+	Username string `json:"username"` // optional filters
+	Param    string `json:"param"`
+}
+
+func (p *subscribeParams) check(errs *paramErrors) {}
+
+type subscribeSensorsParams struct {
+	Username string `json:"username"` // optional filter
+}
+
+func (p *subscribeSensorsParams) check(errs *paramErrors) {}
+
+type unsubscribeParams struct {
+	Subscription *int `json:"subscription"`
+}
+
+func (p *unsubscribeParams) check(errs *paramErrors) {
+	errs.required("subscription", p.Subscription != nil)
+}
+
+type blockIdParams struct {
+	Id *int `json:"id"`
+}
+
+func (p *blockIdParams) check(errs *paramErrors) {
+	if errs.required("id", p.Id != nil) && *p.Id < 0 {
+		errs.add("id", "%d is negative", *p.Id)
+	}
+}
+
+type receiptParams struct {
+	blockIdParams
+	Hash string `json:"hash"`
+}
+
+func (p *receiptParams) check(errs *paramErrors) {
+	p.blockIdParams.check(errs)
+	errs.required("hash", p.Hash != "")
+}
+
+type proofParams struct {
+	blockIdParams
+	Username string  `json:"username"`
+	Seq      *uint64 `json:"seq"`
+}
+
+func (p *proofParams) check(errs *paramErrors) {
+	p.blockIdParams.check(errs)
+	errs.required("username", p.Username != "")
+	errs.required("seq", p.Seq != nil)
+}
+
+// stateAtParams takes either a block id or a time.
+type stateAtParams struct {
+	Id   *int   `json:"id"`
+	Time string `json:"time"`
+	at   time.Time
+}
+
+func (p *stateAtParams) check(errs *paramErrors) {
+	switch {
+	case p.Id != nil && p.Time != "":
+		errs.add("time", "give either id or time, not both")
+	case p.Time != "":
+		p.at = errs.timestamp("time", p.Time)
+	case p.Id == nil:
+		errs.add("id", "required unless time is given")
+	}
+}
+
+// limit is how many blocks to return, capped at maxBlocksPerRequest.
+func (errs *paramErrors) limit(limit *int) int {
+	if limit == nil || *limit > maxBlocksPerRequest {
+		return maxBlocksPerRequest
+	}
+	if *limit < 1 {
+		errs.add("limit", "%d is not positive", *limit)
+	}
+	return *limit
+}
+
+type blocksParams struct {
+	From  *int `json:"from"`
+	To    *int `json:"to"`
+	Limit *int `json:"limit"`
+	to    int
+	limit int
+}
+
+func (p *blocksParams) check(errs *paramErrors) {
+	errs.required("from", p.From != nil)
+	p.to = math.MaxInt32
+	if p.To != nil {
+		p.to = *p.To
+	}
+	p.limit = errs.limit(p.Limit)
+}
+
+type blocksByTimeParams struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Limit    *int   `json:"limit"`
+	from, to time.Time
+	limit    int
+}
+
+func (p *blocksByTimeParams) check(errs *paramErrors) {
+	if errs.required("from", p.From != "") {
+		p.from = errs.timestamp("from", p.From)
+	}
+	if errs.required("to", p.To != "") {
+		p.to = errs.timestamp("to", p.To)
+	}
+	p.limit = errs.limit(p.Limit)
+}
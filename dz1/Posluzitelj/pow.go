@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+)
+
+// difficulty is the number of leading zero bits required of every new block
+// hash; 0 turns proof-of-work off.
+var difficulty int
+
+// mine searches for a nonce that satisfies the block's difficulty and
+// returns how many hashes it took.
+func (blk *Block) mine() uint64 {
+	attempts := uint64(1)
+	for !Chain.MeetsDifficulty(blk.hash, blk.difficulty) {
+		blk.nonce++
+		blk.hash = blk.computeHash()
+		attempts++
+	}
+	return attempts
+}
+
+type MiningStats struct {
+	Difficulty     int     `json:"difficulty"`
+	Blocks         int     `json:"blocks"`
+	Attempts       uint64  `json:"attempts"`
+	TotalSeconds   float64 `json:"totalSeconds"`
+	AverageSeconds float64 `json:"averageSeconds"`
+	MaxSeconds     float64 `json:"maxSeconds"`
+}
+
+var miningStats = make(map[int]*MiningStats)
+var miningMutex sync.Mutex
+
+func recordMining(d int, attempts uint64, took time.Duration) {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+	stats, ok := miningStats[d]
+	if !ok {
+		stats = &MiningStats{Difficulty: d}
+		miningStats[d] = stats
+	}
+	stats.Blocks++
+	stats.Attempts += attempts
+	stats.TotalSeconds += took.Seconds()
+	stats.AverageSeconds = stats.TotalSeconds / float64(stats.Blocks)
+	if took.Seconds() > stats.MaxSeconds {
+		stats.MaxSeconds = took.Seconds()
+	}
+	if d > 0 {
+		log.Printf("Mined block at difficulty %d in %s after %d attempts\n", d, took, attempts)
+	}
+}
+
+// GetMiningStats returns how long mining took so far, per difficulty.
+func GetMiningStats() []MiningStats {
+	miningMutex.Lock()
+	defer miningMutex.Unlock()
+	sol := make([]MiningStats, 0, len(miningStats))
+	for _, stats := range miningStats {
+		sol = append(sol, *stats)
+	}
+	sort.Slice(sol, func(i, j int) bool { return sol[i].Difficulty < sol[j].Difficulty })
+	return sol
+}
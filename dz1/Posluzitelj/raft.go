@@ -0,0 +1,843 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+)
+
+// A small Raft: the leader appends commands to its log, replicates them to
+// the followers and every node applies a command once a majority stores it.
+// Every raftCompact applied commands the log up to there is replaced by a
+// snapshot of the state; a follower too far behind is sent the snapshot, in
+// chunks small enough to each arrive within peerTimeout.
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+const (
+	heartbeatInterval = 100 * time.Millisecond
+	electionTimeout   = 500 * time.Millisecond
+	commitTimeout     = 5 * time.Second
+	peerTimeout       = time.Second
+	snapshotChunk     = 256 << 10 // bytes of snapshot sent per call
+)
+
+// raftCompact is how many applied commands the log keeps before they are
+// compacted into a snapshot, 0 keeps them all. The snapshot holds the whole
+// chain, so compacting costs as much as writing it out.
+var raftCompact int
+
+// stateMachine is what Raft replicates: execute runs a committed command,
+// snapshot and restore save and bring back everything applied so far.
+type stateMachine interface {
+	execute(cmd command) (interface{}, error)
+	snapshot() ([]byte, error)
+	restore(data []byte) error
+}
+
+// command is a replicated change to the sensor registry or the chain.
+type command struct {
+	Op           string         `json:"op"` // "noop", "register", "append", "import", "heartbeat", "unregister", "expire" or "update"
+	Sensor       *Vertex        `json:"sensor,omitempty"`
+	Username     string         `json:"username,omitempty"`
+	Update       *SensorUpdate  `json:"update,omitempty"`
+	Measurements []Measurement  `json:"measurements,omitempty"`
+	Blocks       []Chain.Record `json:"blocks,omitempty"`
+	Time         time.Time      `json:"time"`
+	Difficulty   int            `json:"difficulty"`
+	// At is when the sensor signed the request, for the ones it signs.
+	At time.Time `json:"at,omitempty"`
+	// Expires is when the leases of the sensors the command touches run
+	// out, zero when leases are off.
+	Expires time.Time `json:"expires"`
+}
+
+type raftEntry struct {
+	Term uint64  `json:"term"`
+	Cmd  command `json:"cmd"`
+}
+
+// raftRecord is a line of the raft storage file: either the current term and
+// vote, or an entry written at Index which drops everything after it.
+type raftRecord struct {
+	Term     uint64     `json:"term,omitempty"`
+	VotedFor string     `json:"votedFor,omitempty"`
+	Index    int        `json:"index,omitempty"`
+	Entry    *raftEntry `json:"entry,omitempty"`
+}
+
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "Not the leader, no leader elected yet"
+	}
+	return "Not the leader, leader is " + e.Leader
+}
+
+type applyResult struct {
+	sol interface{}
+	err error
+}
+
+type waiter struct {
+	term uint64
+	ch   chan applyResult
+}
+
+// raftSnapshot is the state as of log entry Index, stored next to the log.
+type raftSnapshot struct {
+	Index int    `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+type Raft struct {
+	mutex    sync.Mutex
+	id       string
+	token    string // peers prove themselves with it
+	peers    []*peer
+	role     int
+	term     uint64
+	votedFor string
+	leader   string
+	// log[0] stands for entry base, the last one compacted into snapshot,
+	// and holds its term; log[i] is entry base+i.
+	log      []raftEntry
+	base     int
+	snapshot []byte
+	// incoming is the snapshot being received from the leader, up to the
+	// chunks that arrived so far, of entry incomingIndex.
+	incoming      []byte
+	incomingIndex int
+	commitIndex   int
+	lastApplied   int
+	nextIndex     map[string]int
+	matchIndex    map[string]int
+	heard         time.Time // last contact with a leader, or last heartbeat sent
+	timeout       time.Duration
+	waiters       map[int]waiter
+	committed     *sync.Cond
+	machine       stateMachine
+	storage       *os.File
+	path          string
+}
+
+// NewRaft loads the snapshot, term, vote and log stored at path and starts
+// taking part in elections. Every committed command is applied to machine,
+// in log order. Peers have to know token.
+func NewRaft(id string, peers []string, path, token string, machine stateMachine) (*Raft, error) {
+	r := &Raft{
+		id:         id,
+		token:      token,
+		log:        []raftEntry{{}},
+		nextIndex:  make(map[string]int),
+		matchIndex: make(map[string]int),
+		heard:      time.Now(),
+		timeout:    randomTimeout(),
+		waiters:    make(map[int]waiter),
+		machine:    machine,
+		path:       path,
+	}
+	r.committed = sync.NewCond(&r.mutex)
+	for _, addr := range peers {
+		r.peers = append(r.peers, &peer{addr: addr, token: token})
+	}
+	if data, err := ioutil.ReadFile(r.snapshotPath()); err == nil {
+		snap := raftSnapshot{}
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", r.snapshotPath(), err))
+		}
+		// the applier restores it before applying anything after it
+		r.log[0].Term, r.base, r.snapshot = snap.Term, snap.Index, snap.Data
+		r.commitIndex = snap.Index
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(f)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec := raftRecord{}
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+		}
+		if rec.Entry == nil {
+			r.term, r.votedFor = rec.Term, rec.VotedFor
+		} else if rec.Index <= r.base {
+			// already in the snapshot, the log was not rewritten yet
+		} else if rec.Index <= r.lastIndex()+1 {
+			r.log = append(r.log[:rec.Index-r.base], *rec.Entry)
+		} else {
+			return nil, errors.New(fmt.Sprintf("%s: gap before entry %d", path, rec.Index))
+		}
+	}
+	r.storage = f
+	go r.run()
+	go r.applier()
+	return r, nil
+}
+
+func randomTimeout() time.Duration {
+	return electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout)))
+}
+
+func (r *Raft) persist(rec raftRecord) {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := r.storage.Write(append(b, '\n')); err != nil {
+		log.Fatal(err)
+	}
+	if err := r.storage.Sync(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (r *Raft) persistState() {
+	r.persist(raftRecord{Term: r.term, VotedFor: r.votedFor})
+}
+
+func (r *Raft) persistEntry(index int) {
+	r.persist(raftRecord{Index: index, Entry: &r.log[index-r.base]})
+}
+
+func (r *Raft) lastIndex() int {
+	return r.base + len(r.log) - 1
+}
+
+// entry returns log entry index, which must not be before base.
+func (r *Raft) entry(index int) raftEntry {
+	return r.log[index-r.base]
+}
+
+func (r *Raft) snapshotPath() string {
+	return r.path + ".snapshot"
+}
+
+// saveSnapshot makes data, the state as of entry index of term, the new
+// start of the log, dropping every entry up to it and keeping the rest.
+func (r *Raft) saveSnapshot(index int, term uint64, data []byte) {
+	if index <= r.lastIndex() && r.entry(index).Term == term {
+		r.log = append([]raftEntry{{Term: term}}, r.log[index-r.base+1:]...)
+	} else {
+		r.log = []raftEntry{{Term: term}}
+	}
+	r.base, r.snapshot = index, data
+
+	b, err := json.Marshal(raftSnapshot{Index: index, Term: term, Data: data})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeSynced(r.snapshotPath(), b); err != nil {
+		log.Fatal(err)
+	}
+	// rewrite the log without the entries the snapshot holds
+	recs := []raftRecord{{Term: r.term, VotedFor: r.votedFor}}
+	for i := range r.log[1:] {
+		recs = append(recs, raftRecord{Index: index + 1 + i, Entry: &r.log[1+i]})
+	}
+	b = nil
+	for _, rec := range recs {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		b = append(append(b, line...), '\n')
+	}
+	if err := writeSynced(r.path, b); err != nil {
+		log.Fatal(err)
+	}
+	f, err := os.OpenFile(r.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r.storage.Close()
+	r.storage = f
+}
+
+// writeSynced replaces the file at path with data, so that a crash leaves
+// either the old or the new one.
+func writeSynced(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// compact snapshots the state as of the last applied entry and drops the
+// log up to it; only the applier calls it, so nothing is applied meanwhile.
+func (r *Raft) compact() {
+	index, term := r.lastApplied, r.entry(r.lastApplied).Term
+	r.mutex.Unlock()
+	data, err := r.machine.snapshot()
+	r.mutex.Lock()
+	if err != nil {
+		log.Println("Compacting the log failed:", err)
+		return
+	}
+	if index <= r.base {
+		// a snapshot from the leader got there first
+		return
+	}
+	r.saveSnapshot(index, term, data)
+	log.Println("Compacted the log up to entry", index)
+}
+
+func (r *Raft) run() {
+	for {
+		time.Sleep(10 * time.Millisecond)
+		r.mutex.Lock()
+		if r.role == leader && time.Since(r.heard) >= heartbeatInterval {
+			r.heard = time.Now()
+			r.broadcast()
+		} else if r.role != leader && time.Since(r.heard) >= r.timeout {
+			r.startElection()
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func (r *Raft) becomeFollower(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.persistState()
+	}
+	if r.role == leader {
+		log.Println("Stepping down in term", r.term)
+	}
+	r.role = follower
+}
+
+func (r *Raft) startElection() {
+	r.role = candidate
+	r.term++
+	r.votedFor = r.id
+	r.leader = ""
+	r.persistState()
+	r.heard = time.Now()
+	r.timeout = randomTimeout()
+	log.Println("Starting election for term", r.term)
+
+	term, votes := r.term, 1
+	args := voteArgs{
+		Term:         r.term,
+		CandidateId:  r.id,
+		LastLogIndex: r.lastIndex(),
+		LastLogTerm:  r.entry(r.lastIndex()).Term,
+	}
+	for _, p := range r.peers {
+		go func(p *peer) {
+			reply := voteReply{}
+			if err := p.call("raft.requestVote", args, &reply); err != nil {
+				return
+			}
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			if reply.Term > r.term {
+				r.becomeFollower(reply.Term)
+				return
+			}
+			if r.role != candidate || r.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if 2*votes > len(r.peers)+1 {
+				r.becomeLeader()
+			}
+		}(p)
+	}
+}
+
+func (r *Raft) becomeLeader() {
+	log.Println("Elected leader for term", r.term)
+	r.role = leader
+	r.leader = r.id
+	for _, p := range r.peers {
+		r.nextIndex[p.addr] = r.lastIndex() + 1
+		r.matchIndex[p.addr] = 0
+	}
+	// entries from earlier terms only commit along with one from this term
+	r.log = append(r.log, raftEntry{Term: r.term, Cmd: command{Op: "noop"}})
+	r.persistEntry(r.lastIndex())
+	r.heard = time.Now()
+	r.broadcast()
+}
+
+func (r *Raft) broadcast() {
+	for _, p := range r.peers {
+		go r.replicate(p)
+	}
+}
+
+func (r *Raft) replicate(p *peer) {
+	r.mutex.Lock()
+	if r.role != leader {
+		r.mutex.Unlock()
+		return
+	}
+	next := r.nextIndex[p.addr]
+	if next <= r.base {
+		r.sendSnapshot(p)
+		return
+	}
+	args := appendArgs{
+		Term:         r.term,
+		LeaderId:     r.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.entry(next - 1).Term,
+		Entries:      append([]raftEntry{}, r.log[next-r.base:]...),
+		LeaderCommit: r.commitIndex,
+	}
+	r.mutex.Unlock()
+
+	reply := appendReply{}
+	if err := p.call("raft.appendEntries", args, &reply); err != nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if reply.Term > r.term {
+		r.becomeFollower(reply.Term)
+		return
+	}
+	if r.role != leader || r.term != args.Term {
+		return
+	}
+	if reply.Success {
+		if match := args.PrevLogIndex + len(args.Entries); match > r.matchIndex[p.addr] {
+			r.matchIndex[p.addr] = match
+			r.nextIndex[p.addr] = match + 1
+		}
+		r.advanceCommit()
+	} else if next == r.nextIndex[p.addr] {
+		r.nextIndex[p.addr] = next - 1
+		if reply.LastIndex+1 < next {
+			r.nextIndex[p.addr] = reply.LastIndex + 1
+		}
+		if r.nextIndex[p.addr] < 1 {
+			r.nextIndex[p.addr] = 1
+		}
+	}
+}
+
+// sendSnapshot sends p the snapshot chunk by chunk, as the entries it is
+// missing are compacted; the caller holds r.mutex, which is released. Every
+// chunk counts as a heartbeat, the ones replicate sends are skipped until
+// the last chunk is in.
+func (r *Raft) sendSnapshot(p *peer) {
+	if p.sendingSnapshot {
+		r.mutex.Unlock()
+		return
+	}
+	p.sendingSnapshot = true
+	args := snapshotArgs{
+		Term:     r.term,
+		LeaderId: r.id,
+		Index:    r.base,
+		LastTerm: r.log[0].Term,
+	}
+	data := r.snapshot
+	r.mutex.Unlock()
+
+	reply := appendReply{}
+	var err error
+	for offset := 0; ; offset += snapshotChunk {
+		end := offset + snapshotChunk
+		if end > len(data) {
+			end = len(data)
+		}
+		args.Offset, args.Data, args.Done = offset, data[offset:end], end == len(data)
+		reply = appendReply{}
+		if err = p.call("raft.installSnapshot", args, &reply); err != nil || !reply.Success || args.Done {
+			break
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	p.sendingSnapshot = false
+	if err != nil {
+		return
+	}
+	if reply.Term > r.term {
+		r.becomeFollower(reply.Term)
+		return
+	}
+	if r.role != leader || r.term != args.Term || !reply.Success {
+		return
+	}
+	if args.Index > r.matchIndex[p.addr] {
+		r.matchIndex[p.addr] = args.Index
+	}
+	if args.Index+1 > r.nextIndex[p.addr] {
+		r.nextIndex[p.addr] = args.Index + 1
+	}
+}
+
+// advanceCommit commits the newest entry of this term stored on a majority.
+func (r *Raft) advanceCommit() {
+	for n := r.lastIndex(); n > r.commitIndex && r.entry(n).Term == r.term; n-- {
+		count := 1
+		for _, p := range r.peers {
+			if r.matchIndex[p.addr] >= n {
+				count++
+			}
+		}
+		if 2*count > len(r.peers)+1 {
+			r.commitIndex = n
+			r.committed.Broadcast()
+			return
+		}
+	}
+}
+
+func (r *Raft) applier() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for {
+		for r.lastApplied >= r.commitIndex {
+			r.committed.Wait()
+		}
+		if r.lastApplied < r.base {
+			// the entries up to base are only in the snapshot now
+			index, data := r.base, r.snapshot
+			r.mutex.Unlock()
+			if err := r.machine.restore(data); err != nil {
+				log.Fatal("Restoring the snapshot failed: ", err)
+			}
+			r.mutex.Lock()
+			log.Println("Restored the snapshot of entry", index)
+			r.lastApplied = index
+			continue
+		}
+		r.lastApplied++
+		index, entry := r.lastApplied, r.entry(r.lastApplied)
+		w, ok := r.waiters[index]
+		delete(r.waiters, index)
+		r.mutex.Unlock()
+
+		res := applyResult{}
+		if entry.Cmd.Op != "noop" {
+			res.sol, res.err = r.machine.execute(entry.Cmd)
+		}
+		if ok {
+			if w.term != entry.Term {
+				// our entry was overwritten by another leader
+				res = applyResult{err: &NotLeaderError{}}
+			}
+			w.ch <- res
+		}
+		r.mutex.Lock()
+		if raftCompact > 0 && r.lastApplied-r.base >= raftCompact {
+			r.compact()
+		}
+	}
+}
+
+// Propose replicates cmd and returns the result of applying it once it is
+// committed. Only the leader accepts proposals.
+func (r *Raft) Propose(cmd command) (interface{}, error) {
+	r.mutex.Lock()
+	if r.role != leader {
+		r.mutex.Unlock()
+		return nil, &NotLeaderError{Leader: r.leader}
+	}
+	r.log = append(r.log, raftEntry{Term: r.term, Cmd: cmd})
+	index := r.lastIndex()
+	r.persistEntry(index)
+	ch := make(chan applyResult, 1)
+	r.waiters[index] = waiter{term: r.term, ch: ch}
+	r.broadcast()
+	r.mutex.Unlock()
+
+	select {
+	case res := <-ch:
+		return res.sol, res.err
+	case <-time.After(commitTimeout):
+		return nil, errors.New("Timed out waiting for the command to commit")
+	}
+}
+
+// Leader returns the address of the current leader, if known.
+func (r *Raft) Leader() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.leader
+}
+
+type voteArgs struct {
+	Term         uint64 `json:"term"`
+	CandidateId  string `json:"candidateId"`
+	LastLogIndex int    `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type voteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+func (r *Raft) RequestVote(args voteArgs) voteReply {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if args.Term > r.term {
+		r.becomeFollower(args.Term)
+	}
+	reply := voteReply{Term: r.term}
+	lastTerm := r.entry(r.lastIndex()).Term
+	upToDate := args.LastLogTerm > lastTerm ||
+		(args.LastLogTerm == lastTerm && args.LastLogIndex >= r.lastIndex())
+	if args.Term == r.term && (r.votedFor == "" || r.votedFor == args.CandidateId) && upToDate {
+		r.votedFor = args.CandidateId
+		r.persistState()
+		r.heard = time.Now()
+		reply.VoteGranted = true
+	}
+	return reply
+}
+
+type appendArgs struct {
+	Term         uint64      `json:"term"`
+	LeaderId     string      `json:"leaderId"`
+	PrevLogIndex int         `json:"prevLogIndex"`
+	PrevLogTerm  uint64      `json:"prevLogTerm"`
+	Entries      []raftEntry `json:"entries"`
+	LeaderCommit int         `json:"leaderCommit"`
+}
+
+type appendReply struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastIndex lets the leader skip back over a longer missing suffix.
+	LastIndex int `json:"lastIndex"`
+}
+
+// follow makes the sender of a request of term the leader, unless term is
+// an old one; the caller holds r.mutex.
+func (r *Raft) follow(term uint64, leaderId string) bool {
+	if term < r.term {
+		return false
+	}
+	if term > r.term || r.role != follower {
+		r.becomeFollower(term)
+	}
+	if r.leader != leaderId {
+		log.Println("Following leader", leaderId, "in term", term)
+	}
+	r.leader = leaderId
+	r.heard = time.Now()
+	return true
+}
+
+func (r *Raft) AppendEntries(args appendArgs) appendReply {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.follow(args.Term, args.LeaderId) {
+		return appendReply{Term: r.term}
+	}
+	if skip := r.base - args.PrevLogIndex; skip > 0 {
+		// the entries up to base are committed and compacted already
+		if skip > len(args.Entries) {
+			skip = len(args.Entries)
+		}
+		args.PrevLogIndex += skip
+		args.Entries = args.Entries[skip:]
+		if args.PrevLogIndex == r.base {
+			args.PrevLogTerm = r.log[0].Term
+		}
+	}
+	if args.PrevLogIndex < r.base {
+		return appendReply{Term: r.term, Success: true, LastIndex: r.lastIndex()}
+	}
+
+	if args.PrevLogIndex > r.lastIndex() || r.entry(args.PrevLogIndex).Term != args.PrevLogTerm {
+		last := r.lastIndex()
+		if args.PrevLogIndex-1 < last {
+			last = args.PrevLogIndex - 1
+		}
+		return appendReply{Term: r.term, LastIndex: last}
+	}
+	for i, entry := range args.Entries {
+		index := args.PrevLogIndex + 1 + i
+		if index <= r.lastIndex() && r.entry(index).Term == entry.Term {
+			continue
+		}
+		r.log = r.log[:index-r.base]
+		for j, entry := range args.Entries[i:] {
+			r.log = append(r.log, entry)
+			r.persistEntry(index + j)
+		}
+		break
+	}
+	if args.LeaderCommit > r.commitIndex {
+		r.commitIndex = args.LeaderCommit
+		if last := args.PrevLogIndex + len(args.Entries); last < r.commitIndex {
+			r.commitIndex = last
+		}
+		r.committed.Broadcast()
+	}
+	return appendReply{Term: r.term, Success: true, LastIndex: r.lastIndex()}
+}
+
+type snapshotArgs struct {
+	Term     uint64 `json:"term"`
+	LeaderId string `json:"leaderId"`
+	Index    int    `json:"index"`    // the last entry the snapshot holds
+	LastTerm uint64 `json:"lastTerm"` // and its term
+	Offset   int    `json:"offset"`   // where in the snapshot Data goes
+	Data     []byte `json:"data"`
+	Done     bool   `json:"done"` // Data is the last chunk
+}
+
+// InstallSnapshot takes a chunk of the leader's snapshot. Once the last one
+// is in, the snapshot replaces the log up to args.Index, and the state once
+// the applier gets to it.
+func (r *Raft) InstallSnapshot(args snapshotArgs) appendReply {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.follow(args.Term, args.LeaderId) {
+		return appendReply{Term: r.term}
+	}
+	if args.Offset == 0 {
+		r.incoming, r.incomingIndex = nil, args.Index
+	}
+	if args.Index != r.incomingIndex || args.Offset != len(r.incoming) {
+		// a chunk went missing, the leader starts over
+		r.incoming = nil
+		return appendReply{Term: r.term, LastIndex: r.lastIndex()}
+	}
+	r.incoming = append(r.incoming, args.Data...)
+	if !args.Done {
+		return appendReply{Term: r.term, Success: true, LastIndex: r.lastIndex()}
+	}
+	data := r.incoming
+	r.incoming = nil
+	if args.Index > r.commitIndex {
+		log.Println("Installing the snapshot of entry", args.Index, "from", args.LeaderId)
+		r.saveSnapshot(args.Index, args.LastTerm, data)
+		r.commitIndex = args.Index
+		for index, w := range r.waiters {
+			if index <= args.Index {
+				// what became of it is only in the snapshot
+				w.ch <- applyResult{err: &NotLeaderError{Leader: args.LeaderId}}
+				delete(r.waiters, index)
+			}
+		}
+		r.committed.Broadcast()
+	}
+	return appendReply{Term: r.term, Success: true, LastIndex: r.lastIndex()}
+}
+
+// peer is a JSON-RPC connection to another server, reopened on failure.
+type peer struct {
+	addr   string
+	token  string
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	id     int
+	// sendingSnapshot is set while a snapshot is on its way, under the
+	// Raft's mutex.
+	sendingSnapshot bool
+}
+
+func (p *peer) call(method string, args interface{}, reply interface{}) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.conn == nil {
+		conn, err := net.DialTimeout(CONN_TYPE, p.addr, peerTimeout)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+		p.reader = bufio.NewReader(conn)
+	}
+	err := func() error {
+		p.id++
+		params := map[string]json.RawMessage{}
+		b, err := json.Marshal(args)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &params); err != nil {
+			return err
+		}
+		if params["auth"], err = json.Marshal(p.token); err != nil {
+			return err
+		}
+		req, err := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  method,
+			"params":  params,
+			"id":      p.id,
+		})
+		if err != nil {
+			return err
+		}
+		p.conn.SetDeadline(time.Now().Add(peerTimeout))
+		if _, err := p.conn.Write(append(req, '\n')); err != nil {
+			return err
+		}
+		data, err := p.reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		resp := struct {
+			Result json.RawMessage `json:"result"`
+			Error  interface{}     `json:"error"`
+		}{}
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return err
+		}
+		if resp.Error != nil {
+			return errors.New(fmt.Sprint(resp.Error))
+		}
+		return json.Unmarshal(resp.Result, reply)
+	}()
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
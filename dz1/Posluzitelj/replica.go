@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+	"github.com/nmiculinic/rassus/dz1/Geo"
+)
+
+// SensorState is the state machine Raft replicates. Its snapshot holds the
+// sensors, their history and the chain from its base, which is all the
+// commands applied so far leave behind.
+
+type sensorRecord struct {
+	*Vertex
+	Registered time.Time `json:"registered"`
+	Expires    time.Time `json:"expires"`
+}
+
+type stateSnapshot struct {
+	Sensors  []sensorRecord            `json:"sensors"`
+	History  map[string][]SensorChange `json:"history"`
+	SignedAt map[string]time.Time      `json:"signedAt"`
+	Blocks   []Chain.Record            `json:"blocks"`
+}
+
+func (state *SensorState) snapshot() ([]byte, error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	snap := stateSnapshot{History: state.history, SignedAt: state.signedAt}
+	for _, v := range state.sensors {
+		snap.Sensors = append(snap.Sensors, sensorRecord{Vertex: v, Registered: v.registered, Expires: v.expires})
+	}
+	blockMuter.Lock()
+	snap.Blocks = records(blocks)
+	blockMuter.Unlock()
+	return json.Marshal(snap)
+}
+
+func (state *SensorState) restore(data []byte) error {
+	snap := stateSnapshot{}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if err := RestoreChain(snap.Blocks); err != nil {
+		return err
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	state.sensors = make(map[string]*Vertex, len(snap.Sensors))
+	state.index = Geo.NewIndex()
+	for _, rec := range snap.Sensors {
+		v := rec.Vertex
+		v.registered, v.expires = rec.Registered, rec.Expires
+		state.sensors[v.Username] = v
+		state.index.Insert(v.Username, v.point())
+	}
+	state.history = snap.History
+	if state.history == nil {
+		state.history = make(map[string][]SensorChange)
+	}
+	state.signedAt = snap.SignedAt
+	if state.signedAt == nil {
+		state.signedAt = make(map[string]time.Time)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Geo"
+)
+
+// Neighbour is a sensor and how far it is from where the search started.
+type Neighbour struct {
+	*Vertex
+	Distance float64 `json:"distance"` // km
+}
+
+// neighbours returns the live sensors other than skip no further than km
+// from p, nearest first, at most k of them when k > 0. Needs state.mutex.
+func (state *SensorState) neighbours(p Geo.Point, skip string, km float64, k int, now time.Time) []Neighbour {
+	hits := state.index.Nearest(p, k, km, func(username string) bool {
+		// expired sensors stay indexed until they are evicted
+		return username != skip && !state.sensors[username].expired(now)
+	})
+	sol := make([]Neighbour, len(hits))
+	for i, hit := range hits {
+		sol[i] = Neighbour{Vertex: state.sensors[hit.Key], Distance: hit.Distance}
+	}
+	return sol
+}
+
+// What search does when no sensor measures every param asked for.
+const (
+	fallbackNearest = "nearest" // the nearest sensor, whatever it measures
+	fallbackMost    = "most"    // the nearest of those measuring most of them, if any
+	fallbackNone    = "none"    // no sensor
+)
+
+// covers counts how many of params v measures.
+func (v *Vertex) covers(params []string) int {
+	sol := 0
+	for _, param := range params {
+		for _, has := range v.Params {
+			if has == param {
+				sol++
+				break
+			}
+		}
+	}
+	return sol
+}
+
+// search returns the sensor nearest to username that measures all of
+// params, or what fallback picks when none does; nil when there is none.
+func (state *SensorState) search(username string, params []string, fallback string) (*Vertex, error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	now := time.Now()
+	target := state.sensor(username, now)
+	if target == nil {
+		return nil, errors.New(fmt.Sprintf("Cannot found %s in sensors list", username))
+	}
+	hits := state.index.Nearest(target.point(), 1, math.Inf(+1), func(other string) bool {
+		v := state.sensors[other]
+		return other != username && !v.expired(now) && v.covers(params) == len(params)
+	})
+	if len(hits) > 0 {
+		return state.sensors[hits[0].Key], nil
+	}
+	switch fallback {
+	case fallbackNearest:
+		if sol := state.neighbours(target.point(), username, math.Inf(+1), 1, now); len(sol) > 0 {
+			return sol[0].Vertex, nil
+		}
+	case fallbackMost:
+		var sol *Vertex
+		most := 0
+		for _, n := range state.neighbours(target.point(), username, math.Inf(+1), 0, now) {
+			if c := n.covers(params); c > most {
+				sol, most = n.Vertex, c
+			}
+		}
+		return sol, nil
+	}
+	return nil, nil
+}
+
+// searchK returns the k sensors nearest to username, nearest first.
+func (state *SensorState) searchK(username string, k int) ([]Neighbour, error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	now := time.Now()
+	target := state.sensor(username, now)
+	if target == nil {
+		return nil, errors.New(fmt.Sprintf("Cannot found %s in sensors list", username))
+	}
+	return state.neighbours(target.point(), username, math.Inf(+1), k, now), nil
+}
+
+// searchRadius returns the sensors within km of (lat, lon), nearest first.
+func (state *SensorState) searchRadius(lat, lon, km float64) []Neighbour {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.neighbours(Geo.Point{Lat: lat, Lon: lon}, "", km, 0, time.Now())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Geo"
+)
+
+// testState holds sensors due north of (45, 16), one per username, at
+// about 111 km per degree of latitude given.
+func testState(t *testing.T, sensors map[string]float64, params map[string][]string) *SensorState {
+	state := &SensorState{
+		sensors:  make(map[string]*Vertex),
+		index:    Geo.NewIndex(),
+		history:  make(map[string][]SensorChange),
+		signedAt: make(map[string]time.Time),
+	}
+	for username, dlat := range sensors {
+		v := &Vertex{Username: username, Lat: 45 + dlat, Lon: 16, Params: params[username]}
+		if _, err := state.addSensor(v, time.Now(), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return state
+}
+
+func TestSearchK(t *testing.T) {
+	state := testState(t, map[string]float64{
+		"origin": 0, "far": 3, "near": 0.5, "middle": 1, "south": -2,
+	}, nil)
+	state.sensors["gone"] = &Vertex{Username: "gone", Lat: 45.1, Lon: 16, expires: time.Now().Add(-time.Second)}
+	state.index.Insert("gone", state.sensors["gone"].point())
+
+	tests := []struct {
+		k    int
+		want []string
+	}{
+		{1, []string{"near"}},
+		{3, []string{"near", "middle", "south"}},
+		{0, []string{"near", "middle", "south", "far"}},
+		{10, []string{"near", "middle", "south", "far"}},
+	}
+	for _, test := range tests {
+		sol, err := state.searchK("origin", test.k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for i, n := range sol {
+			got = append(got, n.Username)
+			if i > 0 && n.Distance < sol[i-1].Distance {
+				t.Errorf("k=%d: %s at %.1f km after %s at %.1f km", test.k, n.Username, n.Distance, sol[i-1].Username, sol[i-1].Distance)
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("k=%d: got %v, want %v", test.k, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("k=%d: got %v, want %v", test.k, got, test.want)
+				break
+			}
+		}
+	}
+	if _, err := state.searchK("nobody", 1); err == nil {
+		t.Error("searchK of an unknown sensor succeeded")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	state := testState(t, map[string]float64{
+		"origin": 0, "near": 0.5, "middle": 1, "far": 3,
+	}, map[string][]string{
+		"near":   {"temperature"},
+		"middle": {"temperature", "humidity"},
+		"far":    {"temperature", "humidity", "pressure"},
+	})
+	tests := []struct {
+		params   []string
+		fallback string
+		want     string // empty for none
+	}{
+		{nil, fallbackNone, "near"},
+		{[]string{"temperature"}, fallbackNone, "near"},
+		{[]string{"humidity"}, fallbackNone, "middle"},
+		{[]string{"pressure", "humidity"}, fallbackNone, "far"},
+		{[]string{"co2"}, fallbackNone, ""},
+		{[]string{"co2"}, fallbackNearest, "near"},
+		{[]string{"co2", "humidity"}, fallbackMost, "middle"},
+		{[]string{"co2", "pressure"}, fallbackMost, "far"},
+		{[]string{"co2"}, fallbackMost, ""},
+	}
+	for _, test := range tests {
+		sol, err := state.search("origin", test.params, test.fallback)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if sol != nil {
+			got = sol.Username
+		}
+		if got != test.want {
+			t.Errorf("search(%v, %s) = %q, want %q", test.params, test.fallback, got, test.want)
+		}
+	}
+}
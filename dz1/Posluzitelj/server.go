@@ -2,21 +2,31 @@ package main
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"math"
 	"net"
+	"os"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+	"github.com/nmiculinic/rassus/dz1/Geo"
+	"github.com/nmiculinic/rassus/dz1/Signature"
 )
 
 const (
 	CONN_HOST = "localhost"
 	CONN_PORT = "3333"
 	CONN_TYPE = "tcp"
+
+	maxBlocksPerRequest = 1000
 )
 
 type Vertex struct {
@@ -25,137 +35,344 @@ type Vertex struct {
 	Lon      float64 `json:"lon"`
 	Ip       net.IP  `json:"ip"`
 	Port     int     `json:"port"`
+	// PublicKey verifies the signatures on the sensor's measurements.
+	PublicKey ed25519.PublicKey `json:"publicKey"`
+	// Params are what the sensor measures, as given when it registered.
+	Params []string `json:"params,omitempty"`
+	// what the sensor says about itself through update
+	Owner    string            `json:"owner,omitempty"`
+	Model    string            `json:"model,omitempty"`
+	Firmware string            `json:"firmware,omitempty"`
+	Units    map[string]string `json:"units,omitempty"` // by param
+	// the sensor is dropped once expires passes, unless it is zero
+	registered, expires time.Time
 }
 
-func square(x float64) float64 {
-	return x * x
+func (this *Vertex) expired(now time.Time) bool {
+	return !this.expires.IsZero() && !now.Before(this.expires)
 }
 
-func (this *Vertex) dist(other *Vertex) float64 {
-	if this == nil {
-		return math.Inf(+1)
-	}
-	R := 6371.0 // Earth diameter
-	dlon := other.Lon - this.Lon
-	dlat := other.Lat - this.Lat
-	a := square(math.Sin(dlat/2)) + math.Cos(this.Lat)*math.Cos(other.Lat)*square(math.Sin(dlon/2))
-	c := 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
-	d := R * c
-	return d
+func (this *Vertex) point() Geo.Point {
+	return Geo.Point{Lat: this.Lat, Lon: this.Lon}
 }
 
 type SensorState struct {
 	sensors map[string]*Vertex
-	mutex   sync.Mutex
+	// index finds sensors by location, it holds every one in sensors
+	index *Geo.Index
+	// history is every sensor's audit trail, kept after it is gone
+	history map[string][]SensorChange
+	// signedAt is the newest time each sensor signed a request at; the next
+	// one must be signed later, so a captured request can't be replayed.
+	signedAt map[string]time.Time
+	mutex    sync.Mutex
+	// raft replicates every change when running with peers, nil otherwise.
+	raft *Raft
+}
+
+// submit applies cmd directly, or through the replicated log when running
+// with peers.
+func (state *SensorState) submit(cmd command) (interface{}, error) {
+	if state.raft == nil {
+		return state.execute(cmd)
+	}
+	return state.raft.Propose(cmd)
+}
+
+// execute applies a command; with replication every node runs it in the
+// same order, so it must not depend on anything but cmd and prior commands.
+func (state *SensorState) execute(cmd command) (interface{}, error) {
+	switch cmd.Op {
+	case "register":
+		return state.addSensor(cmd.Sensor, cmd.Time, cmd.Expires)
+	case "append":
+		sol, err := Append(cmd.Measurements, cmd.Time, cmd.Difficulty)
+		if err == nil {
+			// storing measurements keeps the sensor alive as well
+			for _, m := range cmd.Measurements {
+				state.renewLease(m.Username, cmd.Time, cmd.Expires)
+			}
+		}
+		return sol, err
+	case "heartbeat":
+		state.signed(cmd.Username, cmd.At)
+		return state.renewLease(cmd.Username, cmd.Time, cmd.Expires), nil
+	case "unregister":
+		state.signed(cmd.Username, cmd.At)
+		return state.removeSensor(cmd.Username, cmd.Time), nil
+	case "expire":
+		return state.evict(cmd.Time), nil
+	case "update":
+		state.signed(cmd.Username, cmd.At)
+		return state.applyUpdate(cmd.Username, cmd.Update, cmd.Time)
+	case "import":
+		return state.importBlocks(cmd.Blocks)
+	default:
+		return nil, errors.New("Unknown command " + cmd.Op)
+	}
+}
+
+// importBlocks imports recs, checking the signatures of the sensors this
+// server knows, whether or not their lease is still running.
+func (state *SensorState) importBlocks(recs []Chain.Record) (*Block, error) {
+	state.mutex.Lock()
+	keys := make(map[string]ed25519.PublicKey, len(state.sensors))
+	for username, v := range state.sensors {
+		keys[username] = v.PublicKey
+	}
+	state.mutex.Unlock()
+	return ImportBlocks(recs, keys)
+}
+
+// Registration is what register returns: the lease, and the last sequence
+// number stored for the username, which the sensor's measurements must
+// carry on from, also after the username was registered before.
+type Registration struct {
+	Lease
+	Seq uint64 `json:"seq"`
+}
+
+func (state *SensorState) register(username string, lat, lon float64, ip string, port int, publicKey []byte, params []string) (*Registration, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return nil, errors.New(fmt.Sprint("Invalid public key size ", len(publicKey)))
+	}
+	now := time.Now()
+	sol, err := state.submit(command{Op: "register", Sensor: &Vertex{
+		Username:  username,
+		Lat:       lat,
+		Lon:       lon,
+		Ip:        net.ParseIP(ip),
+		Port:      port,
+		PublicKey: publicKey,
+		Params:    params,
+	}, Time: now, Expires: leaseExpiry(now)})
+	if err != nil {
+		return nil, err
+	}
+	return sol.(*Registration), nil
 }
 
-func (state *SensorState) register(username string, lat, lon float64, ip string, port int) (bool, error) {
+// addSensor registers v at time at, taking over the username from a sensor
+// whose lease has run out.
+func (state *SensorState) addSensor(v *Vertex, at, expires time.Time) (*Registration, error) {
 	state.mutex.Lock()
 	defer state.mutex.Unlock()
 	log.Println(state.sensors)
-	if _, fail := state.sensors[username]; fail {
+	if old, fail := state.sensors[v.Username]; fail && !old.expired(at) {
 		log.Println(state.sensors)
 		log.Println(fail)
-		return false, errors.New("Sensor already exists")
+		return nil, errors.New("Sensor already exists")
 	}
-	state.sensors[username] = &Vertex{
-		Username: username,
-		Lat:      lat,
-		Lon:      lon,
-		Ip:       net.ParseIP(ip),
-		Port:     port,
+	v.registered, v.expires = at, expires
+	state.sensors[v.Username] = v
+	state.index.Insert(v.Username, v.point())
+	state.audit(v, "register", at, nil)
+	sol := &Registration{Lease: Lease{Username: v.Username}, Seq: LastSeq(v.Username)}
+	if !expires.IsZero() {
+		sol.Expires = &expires
 	}
-	return true, nil
+	return sol, nil
+}
+
+func (state *SensorState) storeMeasurement(username string, parameter string, averageValue float64, measured time.Time, seq uint64, sig []byte) (*Receipt, error) {
+	return state.storeMeasurements([]Measurement{{
+		Username: username,
+		Param:    parameter,
+		Value:    averageValue,
+		Measured: measured,
+		Seq:      seq,
+		Sig:      sig,
+	}})
 }
 
-func (state *SensorState) search(username string) (*Vertex, error) {
+// storeMeasurements runs every measurement past the validator, checks its
+// signature and stores the whole batch in one block, returning the receipt
+// for it.
+func (state *SensorState) storeMeasurements(measurements []Measurement) (*Receipt, error) {
+	now := time.Now()
 	state.mutex.Lock()
-	defer state.mutex.Unlock()
-	target, ok := state.sensors[username]
-	if !ok {
-		return nil, errors.New(fmt.Sprintf("Cannot found %s in sensors list", username))
-	}
-	var sol *Vertex = nil
-	var dist float64 = math.Inf(+1)
-	for k, v := range state.sensors {
-		if k != username {
-			if sol == nil || target.dist(v) < dist {
-				sol = v
-				dist = sol.dist(v)
-			}
+	// later measurements in the batch are judged against earlier ones
+	pending := make(map[string]reading)
+	for i := range measurements {
+		m := &measurements[i]
+		known := state.sensor(m.Username, now) != nil
+		r, ok := pending[m.Username+"\x00"+m.Param]
+		if !ok {
+			r.Previous, r.PreviousAt, r.HasPrevious = Previous(m.Username, m.Param)
+		}
+		r.Known = known
+		r.At = now
+		if err := validator.Validate(m, &r); err != nil {
+			state.mutex.Unlock()
+			return nil, err
 		}
+		pending[m.Username+"\x00"+m.Param] = reading{Previous: m.Value, PreviousAt: r.At, HasPrevious: true}
 	}
-	return sol, nil
-}
-
-func (state *SensorState) storeMeasurement(username string, parameter string, averageValue float64) (bool, error) {
-	if blk, err := Append(username, parameter, averageValue); err != nil {
-		return false, err
+	for _, m := range measurements {
+		sensor := state.sensor(m.Username, now)
+		if sensor == nil {
+			state.mutex.Unlock()
+			return nil, errors.New(fmt.Sprintf("Cannot found %s in sensors list", m.Username))
+		}
+		if !Signature.Verify(sensor.PublicKey, m.Sig, m.Username, m.Param, m.Value, m.Measured, m.Seq) {
+			state.mutex.Unlock()
+			return nil, errors.New(fmt.Sprint("Invalid signature for ", m.Param))
+		}
+	}
+	state.mutex.Unlock()
+	if sol, err := state.submit(command{
+		Op:           "append",
+		Measurements: measurements,
+		Time:         now,
+		Difficulty:   difficulty,
+		Expires:      leaseExpiry(now),
+	}); err != nil {
+		return nil, err
 	} else {
+		blk := sol.(*Block)
 		if blk.id%100 == 0 {
-			state, _ := blk.getState()
-			log.Println("Blockchain current state:\n", state)
+			log.Println("Blockchain current state:\n", GetState())
 		}
-		return true, nil
+		return blk.receipt(), nil
+	}
+}
+
+// decodeParams fills the struct v from the params of a request, whose
+// numbers are json.Numbers so they come through exactly.
+func decodeParams(params map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (state *SensorState) raftParams(params map[string]interface{}, v interface{}) error {
+	if state.raft == nil {
+		return errors.New("Replication is not enabled")
 	}
+	return decodeParams(params, v)
 }
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	addr := flag.String("addr", CONN_HOST+":"+CONN_PORT, "Address to listen on, also this node's id among its peers")
+	peers := flag.String("peers", "", "Comma separated addresses of the other servers to replicate with")
+	raftFile := flag.String("raft", "raft.log", "Location of the replicated command log, used with -peers")
+	peerToken := flag.String("peerToken", "", "Secret the servers replicating together authenticate each other with, required with -peers")
+	flag.IntVar(&raftCompact, "raftCompact", 1000, "Compact the replicated command log into a snapshot after this many commands, 0 keeps them all")
+	logFile := flag.String("log", "blockchain.log", "Location of the block log, rebuilt from -raft when replicating")
+	flag.IntVar(&difficulty, "difficulty", 0, "Leading zero bits required of new block hashes, 0 disables proof-of-work; imported blocks need at least as many")
+	keyFile := flag.String("key", "posluzitelj.key", "Location of the key signing checkpoint blocks, created if missing; replicated servers must share it")
+	flag.IntVar(&checkpointEvery, "checkpoint", 0, "Write a signed checkpoint block after every this many blocks, 0 disables them")
+	flag.IntVar(&retain, "retain", 0, "Blocks to keep once a checkpoint makes older ones redundant, the rest are archived; 0 keeps everything")
+	rulesFile := flag.String("rules", "", "JSON file with the rules measurements must pass before they are stored")
+	flag.DurationVar(&leaseTTL, "lease", 30*time.Second, "How long a sensor stays registered without a heartbeat or a measurement, 0 keeps it forever")
+	httpAddr := flag.String("http", "", "Address to serve JSON-RPC on POST /rpc and /ws (WebSocket) and the REST resources at, empty disables HTTP")
+	allowOrigin := flag.String("allowOrigin", "", "Comma separated origins of web pages allowed to call the HTTP gateway and open /ws, * for any, empty for none")
+	adminToken := flag.String("adminToken", "", "Token admin methods like importBlocks need as their auth param, empty refuses them")
+	flag.Parse()
+	if difficulty < 0 || difficulty > 256 {
+		log.Fatal("Difficulty must be between 0 and 256")
+	}
+	if checkpointEvery < 0 || retain < 0 {
+		log.Fatal("Checkpoint and retain can't be negative")
+	}
+	if leaseTTL < 0 {
+		log.Fatal("Lease can't be negative")
+	}
+	if raftCompact < 0 {
+		log.Fatal("Raft compaction can't be negative")
+	}
+	if *peers != "" && *peerToken == "" {
+		log.Fatal("Replicating needs -peerToken")
+	}
+	if retain > 0 && checkpointEvery == 0 {
+		log.Fatal("Pruning needs checkpoint blocks, set -checkpoint")
+	}
+	if *rulesFile != "" {
+		rules, err := LoadRules(*rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		validator = rules
+		log.Printf("Validating measurements with %d rules from %s\n", len(rules), *rulesFile)
+	}
+	key, err := Signature.LoadOrCreateKey(*keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverKey = key
+
+	if *peers != "" {
+		// the replicated log is the source of truth, replaying it
+		// rebuilds the chain
+		log.Println("Replicating with", *peers, "- rebuilding", *logFile, "from", *raftFile)
+		if err := os.Truncate(*logFile, 0); err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+	if err := LoadChain(*logFile); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Loaded blocks %d-%d from %s\n", blocks[0].id, PeekLast().id, *logFile)
+
 	state := &SensorState{
-		sensors: make(map[string]*Vertex),
+		sensors:  make(map[string]*Vertex),
+		index:    Geo.NewIndex(),
+		history:  make(map[string][]SensorChange),
+		signedAt: make(map[string]time.Time),
 	}
+	registry := NewRegistry()
+	registry.Use(recoverPanics, logCalls, countCalls, requirePeer(*peerToken), requireAdmin(*adminToken))
+	registerMethods(registry, state)
 
 	// Listen for incoming connections.
-	l, err := net.Listen(CONN_TYPE, CONN_HOST+":"+CONN_PORT)
+	l, err := net.Listen(CONN_TYPE, *addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	// Close the listener when the application closes.
 	defer l.Close()
-	fmt.Println("Listening on " + CONN_HOST + ":" + CONN_PORT)
+	if *peers != "" {
+		if state.raft, err = NewRaft(*addr, strings.Split(*peers, ","), *raftFile, *peerToken, state); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if leaseTTL > 0 {
+		go state.expireLeases()
+	}
+	if *httpAddr != "" {
+		var origins []string
+		if *allowOrigin != "" {
+			origins = strings.Split(*allowOrigin, ",")
+		}
+		go func() {
+			log.Fatal(serveHTTP(*httpAddr, newGateway(registry, state, origins)))
+		}()
+		fmt.Println("Serving HTTP on " + *httpAddr)
+	}
+	fmt.Println("Listening on " + *addr)
 	for {
 		if conn, err := l.Accept(); err != nil {
 			log.Fatal(err)
 		} else {
-			go handleRequest(state, conn)
+			go handleRequest(registry, conn)
 		}
 	}
 }
 
-type request struct {
-	Jsonrpc string                 `json:"jsonrpc"`
-	Method  string                 `json:"method"`
-	Params  map[string]interface{} `json:"params"`
-	Id      int                    `json:"id"`
-}
-
 func (state *SensorState) test(username string) (string, error) {
 	state.mutex.Lock()
 	defer state.mutex.Unlock()
 	return fmt.Sprintf("Username is %s", username), nil
 }
 
-func (req *request) handleResponse(sol interface{}, err error, conn net.Conn) {
-	if err != nil {
-		conn.Write([]byte(fmt.Sprintf(
-			`{"jsonrpc": "2.0", "error": {"code": -32000, "message": "Server error %s"}, "id": %d}`+"\n", err, req.Id)))
-	} else {
-		b, err := json.Marshal(sol)
-		if err != nil {
-			log.Println(err)
-			conn.Write([]byte(fmt.Sprintf(
-				`{"jsonrpc": "2.0", "error": {"code": -32001, "message": "Server error %s"}, "id": %d}`+"\n", err, req.Id)))
-		} else {
-			conn.Write([]byte(fmt.Sprintf(
-				`{"jsonrpc": "2.0", "result": %s, "id": %d}`+"\n", b, req.Id)))
-		}
-	}
-}
-
-func handleRequest(state *SensorState, conn net.Conn) {
-	defer conn.Close()
-	reader := bufio.NewReader(conn)
+func handleRequest(registry *Registry, raw net.Conn) {
+	defer raw.Close()
+	reader := bufio.NewReader(raw)
+	conn := &syncConn{Conn: raw}
+	defer unsubscribeAll(conn)
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -173,57 +390,9 @@ func handleRequest(state *SensorState, conn net.Conn) {
 			}
 			return
 		}
-		log.Print("got: ", string(recv))
-		if err := singleRequest(recv, conn, state); err != nil {
+		if err := registry.dispatch(recv, conn); err != nil {
 			log.Println(err)
 			return
 		}
 	}
 }
-func singleRequest(recv []byte, conn net.Conn, state *SensorState) error {
-	req := request{}
-	if err := json.Unmarshal(recv, &req); err != nil {
-		conn.Write([]byte(fmt.Sprintf(
-			`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "%s"}, "id": null}`+"\n",
-			err,
-		)))
-		log.Println(err)
-		return err
-	}
-
-	switch req.Method {
-	case "test":
-		sol, err := state.test(req.Params["username"].(string))
-		req.handleResponse(sol, err, conn)
-	case "register":
-		sol, err := state.register(
-			req.Params["username"].(string),
-			req.Params["lat"].(float64),
-			req.Params["lon"].(float64),
-			req.Params["ip"].(string),
-			int(req.Params["port"].(float64)),
-		)
-		req.handleResponse(sol, err, conn)
-	case "search":
-		sol, err := state.search(
-			req.Params["username"].(string),
-		)
-		if sol == nil {
-			req.handleResponse(sol, err, conn)
-		} else {
-			log.Println(*sol)
-			req.handleResponse(*sol, err, conn)
-		}
-	case "storeMeasurement":
-		sol, err := state.storeMeasurement(
-			req.Params["username"].(string),
-			req.Params["param"].(string),
-			req.Params["averageValue"].(float64),
-		)
-		req.handleResponse(sol, err, conn)
-	default:
-		conn.Write([]byte(fmt.Sprintf(
-			`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "%d"}`+"\n", req.Id)))
-	}
-	return nil
-}
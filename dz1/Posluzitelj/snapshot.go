@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+)
+
+// serverKey signs checkpoint blocks. Replicated servers must share it, as
+// every one of them writes the same checkpoints.
+var serverKey ed25519.PrivateKey
+
+// checkpointEvery is how many blocks apart checkpoint blocks are written,
+// 0 turns them off. retain is how many of the newest blocks are kept when
+// pruning, 0 keeps everything.
+var checkpointEvery, retain int
+
+// Snapshot is the full state carried by a checkpoint block, enough to pick
+// the chain up from there without anything older.
+type Snapshot struct {
+	State map[string]map[string]float64
+	Seqs  map[string]uint64
+	Sig   []byte
+}
+
+// snapshotDigest is what the server signs on a checkpoint block: its place in
+// the chain and the state it carries.
+func (blk *Block) snapshotDigest() []byte {
+	return Chain.SnapshotDigest(blk.id, blk.time, blk.prev, blk.snapshot.State, blk.snapshot.Seqs)
+}
+
+func (snap *Snapshot) valid(blk *Block) bool {
+	if serverKey == nil {
+		return false
+	}
+	return ed25519.Verify(serverKey.Public().(ed25519.PublicKey), blk.snapshotDigest(), snap.Sig)
+}
+
+// Checkpoint returns the checkpoint block following blk. With a key the
+// snapshot is signed, otherwise its signature is taken as is.
+func (blk *Block) Checkpoint(snapshot *Snapshot, at time.Time, difficulty int, nonce uint64, key ed25519.PrivateKey) *Block {
+	sol := &Block{
+		prev:       blk.hash,
+		snapshot:   snapshot,
+		id:         blk.id + 1,
+		time:       at,
+		difficulty: difficulty,
+		nonce:      nonce,
+	}
+	if key != nil {
+		snapshot.Sig = ed25519.Sign(key, sol.snapshotDigest())
+	}
+	sol.hash = sol.computeHash()
+	return sol
+}
+
+// emitCheckpoint appends a checkpoint block of the current state and prunes
+// what it makes redundant.
+func emitCheckpoint(at time.Time, difficulty int) error {
+	sol, err := mineAndLink(func(tip *Block) (*Block, error) {
+		snapshot := &Snapshot{
+			State: copyState(latest),
+			Seqs:  make(map[string]uint64, len(seqs)),
+		}
+		for username, seq := range seqs {
+			snapshot.Seqs[username] = seq
+		}
+		cpAt := at
+		if cpAt.Before(tip.time) {
+			cpAt = tip.time
+		}
+		return tip.Checkpoint(snapshot, cpAt, difficulty, 0, serverKey), nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Checkpoint block", sol.id)
+	blockMuter.Lock()
+	defer blockMuter.Unlock()
+	return prune()
+}
+
+// prune drops every block before the newest checkpoint block that is at
+// least retain blocks old. The dropped blocks are archived to a cold file
+// and the block log is rewritten to start at that checkpoint; the caller
+// holds blockMuter.
+func prune() error {
+	if retain <= 0 {
+		return nil
+	}
+	cut := 0
+	for i := len(blocks) - 1; i > 0; i-- {
+		if blocks[i].snapshot != nil && blocks[i].id <= LastBlock.id-retain {
+			cut = i
+			break
+		}
+	}
+	if cut == 0 {
+		return nil
+	}
+	if blockLog != nil {
+		if err := blockLog.Archive(blocks[:cut]); err != nil {
+			return err
+		}
+		if err := blockLog.Rewrite(blocks[cut:]); err != nil {
+			return err
+		}
+	}
+	log.Printf("Pruned blocks %d-%d\n", blocks[0].id, blocks[cut-1].id)
+	blocks = append([]*Block(nil), blocks[cut:]...)
+	base := blocks[0].id
+	i := sort.Search(len(checkpoints), func(i int) bool { return checkpoints[i].block.id >= base })
+	checkpoints = append([]checkpoint(nil), checkpoints[i:]...)
+	return nil
+}
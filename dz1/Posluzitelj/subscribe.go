@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+)
+
+// subscriptionBuffer is how many blocks may wait for a slow subscriber
+// before it is dropped.
+const subscriptionBuffer = 64
+
+// syncConn serializes writes so notifications never interleave with
+// responses on the same connection.
+type syncConn struct {
+	net.Conn
+	mutex sync.Mutex
+}
+
+func (c *syncConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Conn.Write(b)
+}
+
+// A subscriber gets notifications of one method: "block" for new blocks or
+// "sensor" for sensors registering, changing and leaving.
+type subscription struct {
+	id       int
+	conn     net.Conn
+	method   string
+	username string // empty matches every sensor
+	param    string // empty matches every param
+	queue    chan interface{}
+}
+
+// SensorEvent is the params of a sensor notification.
+type SensorEvent struct {
+	Op       string    `json:"op"` // "register", "update", "unregister" or "expire"
+	Username string    `json:"username"`
+	Sensor   *Vertex   `json:"sensor"` // as it is now, or was before it left
+	Time     time.Time `json:"time"`
+}
+
+var subscriptions = make(map[int]*subscription)
+var subscriptionMutex sync.Mutex
+var lastSubscription int
+
+// matches reports whether blk holds a measurement the subscriber asked for.
+// Checkpoint blocks only go to unfiltered subscribers.
+func (sub *subscription) matches(blk *Block) bool {
+	if sub.username == "" && sub.param == "" {
+		return true
+	}
+	for _, m := range blk.measurements {
+		if (sub.username == "" || m.Username == sub.username) && (sub.param == "" || m.Param == sub.param) {
+			return true
+		}
+	}
+	return false
+}
+
+// send pushes what is queued to the subscriber as JSON-RPC notifications
+// until the subscription is cancelled or the connection fails.
+func (sub *subscription) send() {
+	for v := range sub.queue {
+		b, err := json.Marshal(v)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if _, err := sub.conn.Write([]byte(fmt.Sprintf(
+			`{"jsonrpc": "2.0", "method": %q, "params": {"subscription": %d, %q: %s}}`+"\n", sub.method, sub.id, sub.method, b))); err != nil {
+			log.Println(sub.conn.RemoteAddr(), err)
+			unsubscribe(sub.conn, sub.id)
+			return
+		}
+	}
+}
+
+// subscribe registers a subscriber to method; notifications queue up until
+// send is started, so the caller can answer the request first.
+func subscribe(conn net.Conn, method, username, param string) *subscription {
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+	lastSubscription++
+	sub := &subscription{
+		id:       lastSubscription,
+		conn:     conn,
+		method:   method,
+		username: username,
+		param:    param,
+		queue:    make(chan interface{}, subscriptionBuffer),
+	}
+	subscriptions[sub.id] = sub
+	return sub
+}
+
+// unsubscribe cancels subscription id if conn owns it.
+func unsubscribe(conn net.Conn, id int) bool {
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+	sub, ok := subscriptions[id]
+	if !ok || sub.conn != conn {
+		return false
+	}
+	delete(subscriptions, id)
+	close(sub.queue)
+	return true
+}
+
+// unsubscribeAll cancels every subscription made over conn.
+func unsubscribeAll(conn net.Conn) {
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+	for id, sub := range subscriptions {
+		if sub.conn == conn {
+			delete(subscriptions, id)
+			close(sub.queue)
+		}
+	}
+}
+
+// push hands v to sub without waiting; a subscriber that has fallen too
+// far behind is dropped. Needs subscriptionMutex.
+func (sub *subscription) push(v interface{}) {
+	select {
+	case sub.queue <- v:
+	default:
+		log.Println("Dropping subscription", sub.id, "of", sub.conn.RemoteAddr(), "- too slow")
+		delete(subscriptions, sub.id)
+		close(sub.queue)
+	}
+}
+
+// notify sends blk to every matching block subscriber.
+func notify(blk *Block) {
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+	var rec *Chain.Record
+	for _, sub := range subscriptions {
+		if sub.method != "block" || !sub.matches(blk) {
+			continue
+		}
+		if rec == nil {
+			r := blk.record()
+			rec = &r
+		}
+		sub.push(rec)
+	}
+}
+
+// notifySensor sends e to every sensor subscriber watching e's sensor.
+func notifySensor(e *SensorEvent) {
+	subscriptionMutex.Lock()
+	defer subscriptionMutex.Unlock()
+	for _, sub := range subscriptions {
+		if sub.method == "sensor" && (sub.username == "" || sub.username == e.Username) {
+			sub.push(e)
+		}
+	}
+}
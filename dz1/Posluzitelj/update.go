@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Signature"
+)
+
+// SensorUpdate changes the fields of a sensor that are set. Params, when
+// given, replace the old ones; Units are merged, an empty unit drops it.
+type SensorUpdate struct {
+	Lat      *float64          `json:"lat,omitempty"`
+	Lon      *float64          `json:"lon,omitempty"`
+	Ip       string            `json:"ip,omitempty"`
+	Port     *int              `json:"port,omitempty"`
+	Params   []string          `json:"params,omitempty"`
+	Owner    *string           `json:"owner,omitempty"`
+	Model    *string           `json:"model,omitempty"`
+	Firmware *string           `json:"firmware,omitempty"`
+	Units    map[string]string `json:"units,omitempty"`
+}
+
+// FieldChange is a field's value before and after a change.
+type FieldChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// SensorChange is an entry of a sensor's audit history.
+type SensorChange struct {
+	Time    time.Time              `json:"time"`
+	Op      string                 `json:"op"` // "register", "update", "unregister" or "expire"
+	Changes map[string]FieldChange `json:"changes,omitempty"`
+}
+
+// audit adds a change to v's history and tells the sensor subscribers; v
+// is the sensor as it is after the change, or was before it left. Needs
+// state.mutex.
+func (state *SensorState) audit(v *Vertex, op string, at time.Time, changes map[string]FieldChange) {
+	state.history[v.Username] = append(state.history[v.Username], SensorChange{Time: at, Op: op, Changes: changes})
+	notifySensor(&SensorEvent{Op: op, Username: v.Username, Sensor: v, Time: at})
+}
+
+// update applies upd to username once the sensor's signature over the
+// request's params checks out.
+func (state *SensorState) update(username string, at time.Time, sig []byte, params map[string]interface{}, upd *SensorUpdate) (*Vertex, error) {
+	if err := state.checkSigned(username, at, func(key ed25519.PublicKey) bool {
+		return Signature.VerifyRequest(key, sig, "update", params)
+	}); err != nil {
+		return nil, err
+	}
+	sol, err := state.submit(command{Op: "update", Username: username, At: at, Update: upd, Time: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	return sol.(*Vertex), nil
+}
+
+// applyUpdate replaces username's Vertex with an updated copy, so that
+// results handed out earlier do not change under their readers.
+func (state *SensorState) applyUpdate(username string, upd *SensorUpdate, at time.Time) (*Vertex, error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	old := state.sensor(username, at)
+	if old == nil {
+		return nil, errors.New(fmt.Sprintf("Cannot found %s in sensors list", username))
+	}
+	v := *old
+	changes := make(map[string]FieldChange)
+	change := func(field string, from, to interface{}) {
+		changes[field] = FieldChange{Old: from, New: to}
+	}
+	if upd.Lat != nil && *upd.Lat != v.Lat {
+		change("lat", v.Lat, *upd.Lat)
+		v.Lat = *upd.Lat
+	}
+	if upd.Lon != nil && *upd.Lon != v.Lon {
+		change("lon", v.Lon, *upd.Lon)
+		v.Lon = *upd.Lon
+	}
+	if ip := net.ParseIP(upd.Ip); ip != nil && !ip.Equal(v.Ip) {
+		change("ip", v.Ip, ip)
+		v.Ip = ip
+	}
+	if upd.Port != nil && *upd.Port != v.Port {
+		change("port", v.Port, *upd.Port)
+		v.Port = *upd.Port
+	}
+	if upd.Params != nil && fmt.Sprint(upd.Params) != fmt.Sprint(v.Params) {
+		change("params", v.Params, upd.Params)
+		v.Params = upd.Params
+	}
+	if upd.Owner != nil && *upd.Owner != v.Owner {
+		change("owner", v.Owner, *upd.Owner)
+		v.Owner = *upd.Owner
+	}
+	if upd.Model != nil && *upd.Model != v.Model {
+		change("model", v.Model, *upd.Model)
+		v.Model = *upd.Model
+	}
+	if upd.Firmware != nil && *upd.Firmware != v.Firmware {
+		change("firmware", v.Firmware, *upd.Firmware)
+		v.Firmware = *upd.Firmware
+	}
+	if len(upd.Units) > 0 {
+		v.Units = make(map[string]string, len(old.Units)+len(upd.Units))
+		for param, unit := range old.Units {
+			v.Units[param] = unit
+		}
+		for param, unit := range upd.Units {
+			if unit != old.Units[param] {
+				change("units."+param, old.Units[param], unit)
+			}
+			if unit == "" {
+				delete(v.Units, param)
+			} else {
+				v.Units[param] = unit
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return old, nil
+	}
+	state.sensors[username] = &v
+	if v.Lat != old.Lat || v.Lon != old.Lon {
+		state.index.Insert(username, v.point())
+	}
+	state.audit(&v, "update", at, changes)
+	return &v, nil
+}
+
+// getHistory returns the audit history of username, oldest first.
+func (state *SensorState) getHistory(username string) []SensorChange {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return append([]SensorChange{}, state.history[username]...)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// reading is what a rule gets to judge a measurement by.
+type reading struct {
+	Known       bool // the sensor is registered
+	Previous    float64
+	PreviousAt  time.Time // zero when there is no previous value or its time is unknown
+	HasPrevious bool
+	// At is when the server received the measurement, and PreviousAt the
+	// previous value; what the sensor says it measured at can be made up.
+	At time.Time
+}
+
+// Rule accepts a measurement by returning nil, or rejects it with the reason.
+type Rule interface {
+	Name() string
+	Check(m *Measurement, r *reading) error
+}
+
+type finiteRule struct{}
+
+func (finiteRule) Name() string { return "finite" }
+
+func (finiteRule) Check(m *Measurement, r *reading) error {
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return errors.New(fmt.Sprint("value ", m.Value, " is not a number"))
+	}
+	return nil
+}
+
+type knownSensorRule struct{}
+
+func (knownSensorRule) Name() string { return "knownSensor" }
+
+func (knownSensorRule) Check(m *Measurement, r *reading) error {
+	if !r.Known {
+		return errors.New(fmt.Sprintf("sensor %s is not registered", m.Username))
+	}
+	return nil
+}
+
+// rangeRule bounds the values of one param; a missing bound is open.
+type rangeRule struct {
+	Param string   `json:"param"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+}
+
+func (rule *rangeRule) Name() string { return "range" }
+
+func (rule *rangeRule) Check(m *Measurement, r *reading) error {
+	if m.Param != rule.Param {
+		return nil
+	}
+	if rule.Min != nil && m.Value < *rule.Min {
+		return errors.New(fmt.Sprintf("%s %v is below %v", m.Param, m.Value, *rule.Min))
+	}
+	if rule.Max != nil && m.Value > *rule.Max {
+		return errors.New(fmt.Sprintf("%s %v is above %v", m.Param, m.Value, *rule.Max))
+	}
+	return nil
+}
+
+// rateRule bounds how fast a sensor's value of param may change; an empty
+// Param applies to every param.
+type rateRule struct {
+	Param        string  `json:"param"`
+	MaxPerSecond float64 `json:"maxPerSecond"`
+}
+
+func (rule *rateRule) Name() string { return "rate" }
+
+func (rule *rateRule) Check(m *Measurement, r *reading) error {
+	if (rule.Param != "" && m.Param != rule.Param) || !r.HasPrevious || r.PreviousAt.IsZero() {
+		return nil
+	}
+	elapsed := r.At.Sub(r.PreviousAt).Seconds()
+	change := math.Abs(m.Value - r.Previous)
+	if change == 0 {
+		return nil
+	}
+	if elapsed <= 0 || change/elapsed > rule.MaxPerSecond {
+		return errors.New(fmt.Sprintf("%s changed from %v to %v in %.3fs, more than %v per second",
+			m.Param, r.Previous, m.Value, elapsed, rule.MaxPerSecond))
+	}
+	return nil
+}
+
+// ValidationError is a measurement turned down by a rule.
+type ValidationError struct {
+	Username string `json:"username"`
+	Param    string `json:"param"`
+	Seq      uint64 `json:"seq"`
+	Rule     string `json:"rule"`
+	Reason   string `json:"reason"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Measurement %d of %s from %s rejected by %s: %s", e.Seq, e.Param, e.Username, e.Rule, e.Reason)
+}
+
+// Validator runs its rules in order; the first rejection wins.
+type Validator []Rule
+
+// validator always refuses values that are not numbers, the rest comes from
+// the -rules file.
+var validator = Validator{finiteRule{}}
+
+func (v Validator) Validate(m *Measurement, r *reading) error {
+	for _, rule := range v {
+		if err := rule.Check(m, r); err != nil {
+			return &ValidationError{
+				Username: m.Username,
+				Param:    m.Param,
+				Seq:      m.Seq,
+				Rule:     rule.Name(),
+				Reason:   err.Error(),
+			}
+		}
+	}
+	return nil
+}
+
+// LoadRules reads the rules in the file at path, a JSON object like
+//
+//	{"rules": [
+//		{"type": "knownSensor"},
+//		{"type": "range", "param": "Pressure", "min": 0},
+//		{"type": "rate", "param": "CO", "maxPerSecond": 5}
+//	]}
+func LoadRules(path string) (Validator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := struct {
+		Rules []json.RawMessage `json:"rules"`
+	}{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err))
+	}
+	sol := Validator{finiteRule{}}
+	for i, raw := range config.Rules {
+		kind := struct {
+			Type string `json:"type"`
+		}{}
+		if err := json.Unmarshal(raw, &kind); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: rule %d: %s", path, i, err))
+		}
+		switch kind.Type {
+		case "knownSensor":
+			sol = append(sol, knownSensorRule{})
+		case "range":
+			rule := &rangeRule{}
+			if err := json.Unmarshal(raw, rule); err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: rule %d: %s", path, i, err))
+			}
+			if rule.Param == "" {
+				return nil, errors.New(fmt.Sprintf("%s: rule %d: range needs a param", path, i))
+			}
+			sol = append(sol, rule)
+		case "rate":
+			rule := &rateRule{}
+			if err := json.Unmarshal(raw, rule); err != nil {
+				return nil, errors.New(fmt.Sprintf("%s: rule %d: %s", path, i, err))
+			}
+			if rule.MaxPerSecond <= 0 {
+				return nil, errors.New(fmt.Sprintf("%s: rule %d: rate needs a positive maxPerSecond", path, i))
+			}
+			sol = append(sol, rule)
+		default:
+			return nil, errors.New(fmt.Sprintf("%s: rule %d: unknown type %q", path, i, kind.Type))
+		}
+	}
+	return sol, nil
+}
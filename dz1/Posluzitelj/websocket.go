@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A WebSocket (RFC 6455) carries the same JSON-RPC as a TCP connection, a
+// text message per line: a message is one request or batch, and every
+// response and notification is sent as a message of its own.
+
+const (
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessage = 16 << 20
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// close codes
+var (
+	wsProtocolError = []byte{0x03, 0xea} // 1002
+	wsTooBig        = []byte{0x03, 0xf1} // 1009
+)
+
+// wsConn makes a WebSocket look like the newline delimited stream
+// handleRequest reads from and writes to.
+type wsConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	pending    []byte // unread rest of the current message
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		// JSON can only hold line breaks as whitespace, so a pretty
+		// printed request still makes one line
+		msg = bytes.Map(func(r rune) rune {
+			if r == '\n' || r == '\r' {
+				return ' '
+			}
+			return r
+		}, msg)
+		c.pending = append(msg, '\n')
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends one line as a text message.
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsText, bytes.TrimSuffix(b, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.writeFrame(wsClose, []byte{0x03, 0xe8}) // 1000, normal closure
+	})
+	return c.Conn.Close()
+}
+
+// fail closes the WebSocket with code, two bytes, and returns err.
+func (c *wsConn) fail(code []byte, err error) error {
+	c.closeOnce.Do(func() {
+		c.writeFrame(wsClose, code)
+	})
+	return err
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, byte(n>>8), byte(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if _, err := c.Conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.Conn.Write(payload)
+	return err
+}
+
+// readMessage reads frames until a whole text or binary message is in,
+// answering pings along the way. A close frame ends the stream, one that
+// breaks the protocol closes it with 1002.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+			return nil, err
+		}
+		fin, opcode := head[0]&0x80 != 0, head[0]&0x0f
+		if head[1]&0x80 == 0 {
+			return nil, c.fail(wsProtocolError, errors.New("WebSocket frame from client is not masked"))
+		}
+		// no extension was agreed on that would give the RSV bits a meaning
+		if head[0]&0x70 != 0 {
+			return nil, c.fail(wsProtocolError, errors.New("WebSocket frame has RSV bits set"))
+		}
+		control := opcode&0x8 != 0
+		if control && !fin {
+			return nil, c.fail(wsProtocolError, errors.New("WebSocket control frame is fragmented"))
+		}
+		n := uint64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return nil, err
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return nil, err
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if control && n > 125 {
+			return nil, c.fail(wsProtocolError, errors.New(fmt.Sprint("WebSocket control frame of ", n, " bytes")))
+		}
+		if n > wsMaxMessage || uint64(len(msg))+n > wsMaxMessage {
+			return nil, c.fail(wsTooBig, errors.New(fmt.Sprint("WebSocket message over ", wsMaxMessage, " bytes")))
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.closeOnce.Do(func() {
+				c.writeFrame(wsClose, payload)
+			})
+			return nil, io.EOF
+		case wsText, wsBinary:
+			if started {
+				return nil, c.fail(wsProtocolError, errors.New("WebSocket message started inside another"))
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, c.fail(wsProtocolError, errors.New("WebSocket continuation without a message"))
+			}
+		default:
+			return nil, c.fail(wsProtocolError, errors.New(fmt.Sprint("Unknown WebSocket opcode ", opcode)))
+		}
+		msg = append(msg, payload...)
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func headerHas(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocket upgrades GET /ws and then serves it like a TCP connection,
+// subscriptions included. Browsers may only open it from allowed origins.
+func (g *gateway) websocket(w http.ResponseWriter, req *http.Request) {
+	if !allow(w, req, http.MethodGet) {
+		return
+	}
+	// a browser says which page opened the socket; without this check any
+	// site it visits could talk to the server in its name
+	if origin := req.Header.Get("Origin"); origin != "" && !g.allowedOrigin(origin) {
+		writeError(w, http.StatusForbidden, "Origin "+origin+" not allowed")
+		return
+	}
+	if !headerHas(req.Header, "Connection", "upgrade") || !headerHas(req.Header, "Upgrade", "websocket") {
+		writeError(w, http.StatusBadRequest, "Expected a WebSocket upgrade")
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, http.StatusUpgradeRequired, "Unsupported WebSocket version")
+		return
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		writeError(w, http.StatusBadRequest, "Invalid Sec-WebSocket-Key")
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Connection can't be taken over")
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// the server's read timeouts were meant for a request, not for a
+	// connection that stays open for as long as the client likes
+	conn.SetDeadline(time.Time{})
+	accept := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(accept[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	handleRequest(g.registry, &wsConn{Conn: conn, reader: rw.Reader})
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nmiculinic/rassus/dz1/Chain"
+)
+
+// blocksPerRequest matches the most blocks Posluzitelj hands out at once.
+const blocksPerRequest = 1000
+
+const usage = `Usage:
+  revizor export -srv host:port [-format jsonl|csv] [-o file] [-from id] [-to id]
+  revizor import -srv host:port -auth token -i file [-format jsonl|csv]
+  revizor verify -i file [-format jsonl|csv] [-serverKey hex | -srv host:port] [-difficulty bits]
+  revizor prove -srv host:port -id block -username name -seq n
+`
+
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type resp struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Error   *rpcError       `json:"error"`
+	Result  json.RawMessage `json:"result"`
+	Id      int             `json:"id"`
+}
+
+type ServerConn struct {
+	addr   string
+	conn   net.Conn
+	reader *bufio.Reader
+	id     int
+}
+
+// jsonrpc calls method on the server and decodes the result into sol,
+// following redirects to the current leader when the servers are replicated.
+func (server *ServerConn) jsonrpc(method string, params interface{}, sol interface{}) error {
+	for {
+		r, err := server.call(method, params)
+		if err != nil {
+			return err
+		}
+		if r.Error == nil {
+			return json.Unmarshal(r.Result, sol)
+		}
+		if r.Error.Code != -32003 {
+			return errors.New(r.Error.Message)
+		}
+		data := struct {
+			Leader string `json:"leader"`
+		}{}
+		json.Unmarshal(r.Error.Data, &data)
+		if data.Leader != "" {
+			log.Println("Redirected to leader", data.Leader)
+			server.addr = data.Leader
+		} else {
+			// no leader yet, wait for the election
+			time.Sleep(time.Second)
+		}
+		server.close()
+	}
+}
+
+func (server *ServerConn) call(method string, params interface{}) (*resp, error) {
+	if server.conn == nil {
+		conn, err := net.Dial("tcp", server.addr)
+		if err != nil {
+			return nil, err
+		}
+		server.conn = conn
+		server.reader = bufio.NewReader(conn)
+	}
+	server.id++
+	req, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+		"id":      server.id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := server.conn.Write(append(req, '\n')); err != nil {
+		server.close()
+		return nil, err
+	}
+	line, err := server.reader.ReadBytes('\n')
+	if err != nil {
+		server.close()
+		return nil, err
+	}
+	r := &resp{}
+	if err := json.Unmarshal(line, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (server *ServerConn) close() {
+	if server.conn != nil {
+		server.conn.Close()
+		server.conn = nil
+	}
+}
+
+var csvHeader = []string{"id", "time", "root", "difficulty", "nonce", "prev", "hash", "measurements", "snapshot"}
+
+// writeRecords writes one block per line. In CSV the measurements and the
+// snapshot are JSON encoded columns, so nothing the hash covers is lost.
+func writeRecords(w io.Writer, format string, recs []Chain.Record) error {
+	if format == "jsonl" {
+		enc := json.NewEncoder(w)
+		for i := range recs {
+			if err := enc.Encode(&recs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	out := csv.NewWriter(w)
+	if err := out.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		measurements, err := json.Marshal(rec.Measurements)
+		if err != nil {
+			return err
+		}
+		snapshot := ""
+		if rec.Snapshot != nil {
+			b, err := json.Marshal(rec.Snapshot)
+			if err != nil {
+				return err
+			}
+			snapshot = string(b)
+		}
+		if err := out.Write([]string{
+			strconv.Itoa(rec.Id),
+			rec.Time.Format(time.RFC3339Nano),
+			rec.Root,
+			strconv.Itoa(rec.Difficulty),
+			strconv.FormatUint(rec.Nonce, 10),
+			rec.Prev,
+			rec.Hash,
+			string(measurements),
+			snapshot,
+		}); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func readRecords(r io.Reader, format string) ([]Chain.Record, error) {
+	sol := []Chain.Record{}
+	if format == "jsonl" {
+		reader := bufio.NewReader(r)
+		for line := 1; ; line++ {
+			data, err := reader.ReadBytes('\n')
+			if len(strings.TrimSpace(string(data))) != 0 {
+				rec := Chain.Record{}
+				if err := json.Unmarshal(data, &rec); err != nil {
+					return nil, errors.New(fmt.Sprintf("line %d: %s", line, err))
+				}
+				sol = append(sol, rec)
+			}
+			if err == io.EOF {
+				return sol, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for i, row := range rows {
+		if i == 0 {
+			continue
+		}
+		rec, err := csvRecord(row)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("line %d: %s", i+1, err))
+		}
+		sol = append(sol, rec)
+	}
+	return sol, nil
+}
+
+func csvRecord(row []string) (Chain.Record, error) {
+	rec := Chain.Record{}
+	if len(row) != len(csvHeader) {
+		return rec, errors.New(fmt.Sprint("expected ", len(csvHeader), " columns, got ", len(row)))
+	}
+	rec.Root, rec.Prev, rec.Hash = row[2], row[5], row[6]
+	var err error
+	if rec.Id, err = strconv.Atoi(row[0]); err != nil {
+		return rec, err
+	}
+	if rec.Time, err = time.Parse(time.RFC3339Nano, row[1]); err != nil {
+		return rec, err
+	}
+	if rec.Difficulty, err = strconv.Atoi(row[3]); err != nil {
+		return rec, err
+	}
+	if rec.Nonce, err = strconv.ParseUint(row[4], 10, 64); err != nil {
+		return rec, err
+	}
+	if err = json.Unmarshal([]byte(row[7]), &rec.Measurements); err != nil {
+		return rec, err
+	}
+	if row[8] != "" {
+		rec.Snapshot = &Chain.SnapshotRecord{}
+		if err = json.Unmarshal([]byte(row[8]), rec.Snapshot); err != nil {
+			return rec, err
+		}
+	}
+	return rec, nil
+}
+
+// formatOf picks the file format, from the flag or else the file extension.
+func formatOf(format, path string) string {
+	if format != "" {
+		return format
+	}
+	if strings.HasSuffix(path, ".csv") {
+		return "csv"
+	}
+	return "jsonl"
+}
+
+func export(srv *ServerConn, format string, from, to int, w io.Writer) error {
+	report := Chain.Report{}
+	if err := srv.jsonrpc("verifyChain", nil, &report); err != nil {
+		return err
+	}
+	if !report.Valid {
+		log.Println("Server reports an invalid chain from block", report.FirstBadId)
+	}
+	if from < report.Base {
+		from = report.Base
+	}
+	if to < 0 || to > report.Height {
+		to = report.Height
+	}
+	recs := []Chain.Record{}
+	for from <= to {
+		page := []Chain.Record{}
+		if err := srv.jsonrpc("getBlocks", map[string]int{"from": from, "to": to, "limit": blocksPerRequest}, &page); err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, rec := range page {
+			if rec.Id != 0 {
+				recs = append(recs, rec)
+			}
+		}
+		from = page[len(page)-1].Id + 1
+	}
+	log.Printf("Exported %d blocks\n", len(recs))
+	return writeRecords(w, format, recs)
+}
+
+// importChain imports recs in pages, auth being the server's admin token.
+func importChain(srv *ServerConn, recs []Chain.Record, auth string) error {
+	for len(recs) > 0 {
+		n := blocksPerRequest
+		if n > len(recs) {
+			n = len(recs)
+		}
+		tip := Chain.Record{}
+		if err := srv.jsonrpc("importBlocks", map[string]interface{}{"blocks": recs[:n], "auth": auth}, &tip); err != nil {
+			return err
+		}
+		log.Println("Imported up to block", tip.Id)
+		recs = recs[n:]
+	}
+	return nil
+}
+
+// proof is what getProof returns.
+type proof struct {
+	Block Chain.Record      `json:"block"`
+	Index int               `json:"index"`
+	Leaf  string            `json:"leaf"`
+	Proof []Chain.ProofStep `json:"proof"`
+}
+
+// prove asks srv to prove that username's measurement seq is in block id and
+// checks the proof: the block's root and hash, and the path from the
+// measurement to the root.
+func prove(srv *ServerConn, id int, username string, seq uint64) error {
+	p := proof{}
+	if err := srv.jsonrpc("getProof", map[string]interface{}{"id": id, "username": username, "seq": seq}, &p); err != nil {
+		return err
+	}
+	if report := Chain.Verify([]Chain.Record{p.Block}, nil, 0); !report.Valid {
+		return errors.New(fmt.Sprint("Block ", id, " does not verify"))
+	}
+	if p.Index < 0 || p.Index >= len(p.Block.Measurements) {
+		return errors.New(fmt.Sprint("Block ", id, " has no measurement ", p.Index))
+	}
+	if m := p.Block.Measurements[p.Index]; m.Username != username || m.Seq != seq {
+		return errors.New(fmt.Sprintf("Measurement %d of block %d is %d from %s", p.Index, id, m.Seq, m.Username))
+	}
+	leaves, err := p.Block.Leaves()
+	if err != nil {
+		return err
+	}
+	if leaf := hex.EncodeToString(leaves[p.Index]); leaf != p.Leaf {
+		return errors.New(fmt.Sprintf("Leaf is %s, not %s", leaf, p.Leaf))
+	}
+	root, _ := hex.DecodeString(p.Block.Root)
+	if !Chain.VerifyProof(leaves[p.Index], p.Proof, root) {
+		return errors.New("Proof does not lead to the block's root")
+	}
+	return nil
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cmd := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	srvStr := cmd.String("srv", "", "Server to export from, import into, take the checkpoint key from or ask for a proof")
+	format := cmd.String("format", "", "jsonl or csv, by default guessed from the file name")
+	in := cmd.String("i", "", "File to import or verify")
+	out := cmd.String("o", "", "File to export to, standard output if empty")
+	from := cmd.Int("from", 0, "First block to export")
+	to := cmd.Int("to", -1, "Last block to export, -1 for the tip")
+	serverKey := cmd.String("serverKey", "", "Hex public key checkpoint blocks are signed with")
+	auth := cmd.String("auth", "", "The server's admin token, import needs it")
+	difficulty := cmd.Int("difficulty", 0, "Least proof-of-work every verified block must carry, in leading zero bits")
+	id := cmd.Int("id", 0, "Block holding the measurement to prove")
+	username := cmd.String("username", "", "Sensor whose measurement to prove")
+	seq := cmd.Uint64("seq", 0, "Sequence number of the measurement to prove")
+	cmd.Parse(os.Args[2:])
+	srv := &ServerConn{addr: *srvStr}
+
+	switch os.Args[1] {
+	case "export":
+		if *srvStr == "" {
+			log.Fatal("export needs -srv")
+		}
+		w := io.Writer(os.Stdout)
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := export(srv, formatOf(*format, *out), *from, *to, w); err != nil {
+			log.Fatal(err)
+		}
+	case "import", "verify":
+		if *in == "" {
+			log.Fatal(os.Args[1], " needs -i")
+		}
+		f, err := os.Open(*in)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recs, err := readRecords(f, formatOf(*format, *in))
+		f.Close()
+		if err != nil {
+			log.Fatal(*in, ": ", err)
+		}
+		if os.Args[1] == "import" {
+			if *srvStr == "" {
+				log.Fatal("import needs -srv")
+			}
+			if err := importChain(srv, recs, *auth); err != nil {
+				log.Fatal(err)
+			}
+			break
+		}
+
+		var key ed25519.PublicKey
+		if *serverKey == "" && *srvStr != "" {
+			if err := srv.jsonrpc("getServerKey", nil, serverKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *serverKey != "" {
+			if key, err = hex.DecodeString(*serverKey); err != nil || len(key) != ed25519.PublicKeySize {
+				log.Fatal("Invalid server key ", *serverKey)
+			}
+		} else {
+			log.Println("No server key, checkpoint signatures are not checked")
+		}
+		report := Chain.Verify(recs, key, *difficulty)
+		b, _ := json.Marshal(report)
+		fmt.Println(string(b))
+		if !report.Valid {
+			os.Exit(1)
+		}
+	case "prove":
+		if *srvStr == "" || *username == "" {
+			log.Fatal("prove needs -srv and -username")
+		}
+		if err := prove(srv, *id, *username, *seq); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Measurement %d from %s is in block %d\n", *seq, *username, *id)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
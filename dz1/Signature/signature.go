@@ -0,0 +1,138 @@
+package Signature
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fields encodes the values a payload is made of. Strings are length
+// prefixed so that ("ab", "c") and ("a", "bc") differ.
+func fields(username, param string, value float64, seq uint64) []byte {
+	var buf [8]byte
+	sol := make([]byte, 0, 32+len(username)+len(param))
+	binary.BigEndian.PutUint64(buf[:], uint64(len(username)))
+	sol = append(sol, buf[:]...)
+	sol = append(sol, username...)
+	binary.BigEndian.PutUint64(buf[:], uint64(len(param)))
+	sol = append(sol, buf[:]...)
+	sol = append(sol, param...)
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(value))
+	sol = append(sol, buf[:]...)
+	binary.BigEndian.PutUint64(buf[:], seq)
+	return append(sol, buf[:]...)
+}
+
+// Payload returns the bytes a sensor signs for a single measurement, taken
+// at measured, zero if it is not reported.
+func Payload(username, param string, value float64, measured time.Time, seq uint64) []byte {
+	var buf [8]byte
+	if !measured.IsZero() {
+		binary.BigEndian.PutUint64(buf[:], uint64(measured.UnixNano()))
+	}
+	return append(fields(username, param, value, seq), buf[:]...)
+}
+
+func Sign(key ed25519.PrivateKey, username, param string, value float64, measured time.Time, seq uint64) []byte {
+	return ed25519.Sign(key, Payload(username, param, value, measured, seq))
+}
+
+func Verify(key ed25519.PublicKey, sig []byte, username, param string, value float64, measured time.Time, seq uint64) bool {
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(key, Payload(username, param, value, measured, seq), sig)
+}
+
+// LeasePayload returns the bytes a sensor signs to renew (op "heartbeat") or
+// drop (op "unregister") its registration. The prefix keeps it apart from
+// measurement payloads, at keeps old signatures from being replayed.
+func LeasePayload(op, username string, at time.Time) []byte {
+	return append([]byte("lease\x00"), fields(username, op, 0, uint64(at.UnixNano()))...)
+}
+
+func SignLease(key ed25519.PrivateKey, op, username string, at time.Time) []byte {
+	return ed25519.Sign(key, LeasePayload(op, username, at))
+}
+
+func VerifyLease(key ed25519.PublicKey, sig []byte, op, username string, at time.Time) bool {
+	if len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(key, LeasePayload(op, username, at), sig)
+}
+
+// RequestPayload returns the bytes a sensor signs to authorize a call of
+// method: every param but "signature", by name, with its value encoded as
+// JSON. A value reads the same after a round trip through JSON, so client
+// and server agree on it.
+func RequestPayload(method string, params map[string]interface{}) ([]byte, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if name != "signature" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	sol := append([]byte("request\x00"), fields("", method, 0, uint64(len(names)))...)
+	for _, name := range names {
+		value, err := json.Marshal(params[name])
+		if err != nil {
+			return nil, err
+		}
+		sol = append(sol, fields(name, string(value), 0, 0)...)
+	}
+	return sol, nil
+}
+
+func SignRequest(key ed25519.PrivateKey, method string, params map[string]interface{}) ([]byte, error) {
+	payload, err := RequestPayload(method, params)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(key, payload), nil
+}
+
+func VerifyRequest(key ed25519.PublicKey, sig []byte, method string, params map[string]interface{}) bool {
+	payload, err := RequestPayload(method, params)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(key, payload, sig)
+}
+
+// LoadOrCreateKey reads the hex encoded private key seed stored at path,
+// generating and saving a fresh one when the file does not exist yet.
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("Invalid key file " + path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}